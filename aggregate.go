@@ -0,0 +1,264 @@
+/**
+aggregate.go
+Counts and aggregates over the keys of a range
+*/
+
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// BoundingBox is the smallest box holding a set of keys,
+// both bounds are inclusive
+type BoundingBox struct {
+	Min []uint64
+	Max []uint64
+}
+
+// reports whether a key within the box may lie within r
+func (b *BoundingBox) intersectsRange(r *Range) bool {
+	for i := range b.Min {
+		if !r.reachesFrom(i, b.Min[i]) || !r.reachesUpTo(i, b.Max[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// reports whether all keys within the box lie within r
+func (b *BoundingBox) isWithinRange(r *Range) bool {
+	for i := range b.Min {
+		if !r.containsAt(i, b.Min[i]) || !r.containsAt(i, b.Max[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Histogram counts the coordinates of one dimension in equally wide
+// bins, bin i holds values in [Lower + i*Width, Lower + (i+1)*Width)
+type Histogram struct {
+	Lower  uint64
+	Width  uint64
+	Counts []int
+}
+
+type AggregateOptions struct {
+	// number of histogram bins per dimension, no histograms if 0.
+	// The bins cover the range clipped to the bounding box of all
+	// keys ever put.
+	Bins int
+}
+
+type Aggregate struct {
+	Count      int
+	Box        *BoundingBox // nil if Count is 0
+	Histograms []Histogram  // one per dimension, if bins were requested
+}
+
+// returns the number of keys a Scan with the same bounds would return.
+// Subtrees whose box lies within the range are counted without visiting
+// them, so large ranges are much cheaper than a Scan.
+func (t *KDTree) Count(from *Point, to *Point) (int, error) {
+
+	r, err := NewRange(t.kSize, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.CountRange(r)
+}
+
+// like Count, but the range may have exclusive bounds
+func (t *KDTree) CountRange(r *Range) (int, error) {
+
+	if r == nil || r.GetSize() != t.kSize {
+		return 0, errors.New("wrong range size")
+	}
+
+	return t.countQuery(t.root, r), nil
+}
+
+// returns the number of keys a partial Get with the same key would return
+func (t *KDTree) CountMatching(partialKey *Point) (int, error) {
+
+	if partialKey == nil || partialKey.GetSize() != t.kSize {
+		return 0, errors.New("wrong key size")
+	}
+
+	// None coordinates are unbounded, given ones have to match exactly
+	return t.Count(partialKey, partialKey)
+}
+
+func (t *KDTree) countQuery(node *Node, r *Range) int {
+
+	if node == nil || !node.box.intersectsRange(r) {
+		return 0
+	}
+
+	if node.box.isWithinRange(r) {
+		return node.count
+	}
+
+	count := t.countQuery(node.Left, r) + t.countQuery(node.Right, r)
+	if node.Key.IsWithin(r) {
+		count++
+	}
+
+	return count
+}
+
+// returns count, bounding box and optionally per dimension
+// histograms of the keys a Scan with the same bounds would return.
+// Like Count, subtrees within the range are added without visiting them.
+func (t *KDTree) Aggregate(from *Point, to *Point, options *AggregateOptions) (*Aggregate, error) {
+
+	r, err := NewRange(t.kSize, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if options == nil {
+		options = &AggregateOptions{}
+	}
+
+	if options.Bins < 0 {
+		return nil, errors.New("Bins cannot be negative")
+	}
+
+	aggregate := &Aggregate{}
+
+	if options.Bins > 0 {
+		aggregate.Histograms = make([]Histogram, t.kSize)
+		for i := range aggregate.Histograms {
+			aggregate.Histograms[i] = t.newHistogram(i, r, options.Bins)
+		}
+	}
+
+	aggregate.add(t.root, r)
+
+	return aggregate, nil
+}
+
+// adds the keys of the subtree node within r. Subtrees whose box lies
+// within r are added through their count and box, unless their keys
+// fall into different bins of a histogram.
+func (a *Aggregate) add(node *Node, r *Range) {
+
+	if node == nil || !node.box.intersectsRange(r) {
+		return
+	}
+
+	if node.box.isWithinRange(r) && a.addBox(&node.box, node.count) {
+		return
+	}
+
+	a.add(node.Left, r)
+	a.add(node.Right, r)
+
+	if node.Key.IsWithin(r) {
+		a.addKey(node)
+	}
+}
+
+// adds count keys spread over box, reports false without adding
+// them if the box covers several bins of a histogram
+func (a *Aggregate) addBox(box *BoundingBox, count int) bool {
+
+	for i := range a.Histograms {
+		if a.Histograms[i].bin(box.Min[i]) != a.Histograms[i].bin(box.Max[i]) {
+			return false
+		}
+	}
+
+	for i := range a.Histograms {
+		a.Histograms[i].Counts[a.Histograms[i].bin(box.Min[i])] += count
+	}
+
+	a.extendBox(box.Min, box.Max)
+	a.Count += count
+
+	return true
+}
+
+func (a *Aggregate) addKey(node *Node) {
+
+	key := make([]uint64, len(node.Key.coords))
+	for i := range key {
+		key[i] = node.KeyValueAt(i)
+	}
+
+	for i := range a.Histograms {
+		a.Histograms[i].Counts[a.Histograms[i].bin(key[i])]++
+	}
+
+	a.extendBox(key, key)
+	a.Count++
+}
+
+// extends the box of the aggregate to [min, max]
+func (a *Aggregate) extendBox(min []uint64, max []uint64) {
+
+	if a.Box == nil {
+		a.Box = &BoundingBox{
+			Min: append([]uint64(nil), min...),
+			Max: append([]uint64(nil), max...),
+		}
+		return
+	}
+
+	for i := range min {
+		if min[i] < a.Box.Min[i] {
+			a.Box.Min[i] = min[i]
+		}
+		if max[i] > a.Box.Max[i] {
+			a.Box.Max[i] = max[i]
+		}
+	}
+}
+
+// returns empty bins covering dimension i of the range
+// clipped to the bounding box of all keys ever put
+func (t *KDTree) newHistogram(i int, r *Range, bins int) Histogram {
+
+	lower, upper := t.stats.min[i], t.stats.max[i]
+
+	if k := r.minKey.coords[i]; k.IsSome && k.Value > lower {
+		lower = k.Value
+	}
+
+	if k := r.maxKey.coords[i]; k.IsSome && k.Value < upper {
+		upper = k.Value
+	}
+
+	if upper < lower {
+		upper = lower
+	}
+
+	// one more than the even share, so that upper still falls into a
+	// bin. With a single bin over all values this overflows, the width
+	// saturates and bin puts the greatest value into the last bin.
+	width := (upper - lower) / uint64(bins)
+	if width < math.MaxUint64 {
+		width++
+	}
+
+	return Histogram{
+		Lower:  lower,
+		Width:  width,
+		Counts: make([]int, bins),
+	}
+}
+
+// returns the index of the bin holding v
+func (h *Histogram) bin(v uint64) int {
+
+	i := (v - h.Lower) / h.Width
+	if i >= uint64(len(h.Counts)) {
+		return len(h.Counts) - 1
+	}
+
+	return int(i)
+}
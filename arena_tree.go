@@ -0,0 +1,615 @@
+/**
+arena_tree.go
+k-d tree variant storing all nodes in flat slices instead of pointer nodes
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ArenaKDTree behaves like a KDTree with round robin splits, but keeps
+// its nodes in one slice linked by int32 indices and the coordinates of
+// all keys in a single []uint64. Neither slice contains pointers, so the
+// garbage collector does not need to scan the tree, and the nodes of a
+// tree are allocated in a few large blocks instead of one by one.
+// Slots of deleted nodes are reused by later puts.
+type ArenaKDTree struct {
+	kSize  int
+	root   int32
+	nodes  []arenaNode
+	coords []uint64 // key of node i is at coords[i*kSize : (i+1)*kSize]
+	free   []int32  // slots of deleted nodes
+}
+
+type arenaNode struct {
+	value Value
+	axis  int32
+	left  int32
+	right int32
+}
+
+const noNode int32 = -1
+
+func NewArenaKDTree(keySize int) (*ArenaKDTree, error) {
+	if keySize < 1 {
+		return nil, errors.New("key size has to be at least 1")
+	}
+
+	return &ArenaKDTree{kSize: keySize, root: noNode}, nil
+}
+
+func (t *ArenaKDTree) keyAt(n int32) []uint64 {
+	return t.coords[int(n)*t.kSize : (int(n)+1)*t.kSize]
+}
+
+func (t *ArenaKDTree) splitValue(n int32) uint64 {
+	return t.coords[int(n)*t.kSize+int(t.nodes[n].axis)]
+}
+
+func (t *ArenaKDTree) isKeyEqual(n int32, key *Point) bool {
+	for d, k := range t.keyAt(n) {
+		if k != key.coords[d].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// number of stored keys
+func (t *ArenaKDTree) Len() int {
+	return len(t.nodes) - len(t.free)
+}
+
+// like Len, for the same method of KDTree
+func (t *ArenaKDTree) GetNodesCount() int {
+	return t.Len()
+}
+
+// returns a copy of the key of node n
+func (t *ArenaKDTree) pointAt(n int32) Point {
+
+	key := make(Key, t.kSize)
+	for d, v := range t.keyAt(n) {
+		key[d] = UInt64(v)
+	}
+
+	return NewPoint(key)
+}
+
+func (t *ArenaKDTree) nodeValues(nodes []int32) []Value {
+
+	values := make([]Value, len(nodes))
+
+	for i, n := range nodes {
+		values[i] = t.nodes[n].value
+	}
+
+	return values
+}
+
+// returns a slot for a new node holding key
+func (t *ArenaKDTree) newNode(key *Point, value Value, axis int32) int32 {
+
+	node := arenaNode{value: value, axis: axis, left: noNode, right: noNode}
+
+	var n int32
+	if len(t.free) > 0 {
+		n = t.free[len(t.free)-1]
+		t.free = t.free[:len(t.free)-1]
+		t.nodes[n] = node
+	} else {
+		n = int32(len(t.nodes))
+		t.nodes = append(t.nodes, node)
+		t.coords = append(t.coords, make([]uint64, t.kSize)...)
+	}
+
+	for d, k := range key.coords {
+		t.coords[int(n)*t.kSize+d] = k.Value
+	}
+
+	return n
+}
+
+func (t *ArenaKDTree) Put(key *Point, value Value) error {
+
+	if key == nil || key.GetSize() != t.kSize || key.IsPartial() {
+		return errors.New("Wrong key!")
+	}
+
+	if len(t.nodes)-len(t.free) >= math.MaxInt32 {
+		return errors.New("tree is full")
+	}
+
+	if t.root == noNode {
+		t.root = t.newNode(key, value, 0)
+		return nil
+	}
+
+	current := t.root
+
+	for depth := 1; ; depth++ {
+
+		axis := t.nodes[current].axis
+
+		if t.splitValue(current) <= key.coords[axis].Value {
+			if t.nodes[current].right == noNode {
+				n := t.newNode(key, value, int32(depth%t.kSize))
+				t.nodes[current].right = n
+				return nil
+			}
+
+			current = t.nodes[current].right
+
+		} else {
+			if t.nodes[current].left == noNode {
+				n := t.newNode(key, value, int32(depth%t.kSize))
+				t.nodes[current].left = n
+				return nil
+			}
+
+			current = t.nodes[current].left
+		}
+	}
+}
+
+// returns found node and its parent, noNode if missing
+func (t *ArenaKDTree) searchQuery(key *Point) (int32, int32) {
+
+	parent := noNode
+	current := t.root
+
+	for current != noNode {
+
+		if t.isKeyEqual(current, key) {
+			return parent, current
+		}
+
+		parent = current
+
+		if t.splitValue(current) <= key.coords[t.nodes[current].axis].Value {
+			current = t.nodes[current].right
+		} else {
+			current = t.nodes[current].left
+		}
+	}
+
+	return parent, noNode
+}
+
+func (t *ArenaKDTree) Get(key *Point) ([]Value, error) {
+
+	if key.GetSize() != t.kSize {
+		return make([]Value, 0), errors.New("wrong key size")
+	}
+
+	if key.IsPartial() {
+		return t.nodeValues(t.partialSearchQuery(key, t.root, make([]int32, 0, 10))), nil
+	}
+
+	_, n := t.searchQuery(key)
+	if n == noNode {
+		return make([]Value, 0), errors.New("Couldn't find key")
+	}
+
+	return []Value{t.nodes[n].value}, nil
+}
+
+func (t *ArenaKDTree) partialSearchQuery(key *Point, n int32, nodes []int32) []int32 {
+
+	if n == noNode {
+		return nodes
+	}
+
+	if isPartiallyEqualTo(key, t.keyAt(n)) {
+		nodes = append(nodes, n)
+	}
+
+	_, kv := key.GetKeyAt(int(t.nodes[n].axis))
+	split := t.splitValue(n)
+
+	if !kv.IsSome || split > kv.Value {
+		nodes = t.partialSearchQuery(key, t.nodes[n].left, nodes)
+	}
+
+	if !kv.IsSome || split <= kv.Value {
+		nodes = t.partialSearchQuery(key, t.nodes[n].right, nodes)
+	}
+
+	return nodes
+}
+
+func (t *ArenaKDTree) Upsert(key *Point, value Value) error {
+
+	if key == nil || key.GetSize() != t.kSize || key.IsPartial() {
+		return errors.New("Wrong key!")
+	}
+
+	_, n := t.searchQuery(key)
+	if n == noNode {
+		return errors.New("Couldnt find node to upsert")
+	}
+
+	t.nodes[n].value = value
+
+	return nil
+}
+
+func (t *ArenaKDTree) Delete(key *Point) error {
+
+	_, err := t.DeleteReturning(key)
+	return err
+}
+
+// removes the node stored under key and returns its value
+func (t *ArenaKDTree) DeleteReturning(key *Point) (Value, error) {
+
+	if key == nil || key.GetSize() != t.kSize || key.IsPartial() {
+		return *new(Value), errors.New("Wrong key!")
+	}
+
+	parent, n := t.searchQuery(key)
+	if n == noNode {
+		return *new(Value), errors.New("node to delete not found")
+	}
+
+	// the node may take over the key and value of its replacement
+	value := t.nodes[n].value
+	t.deleteNode(parent, n)
+
+	return value, nil
+}
+
+// removes every node a partial Get with the same key would return
+// and returns the number of removed nodes
+func (t *ArenaKDTree) DeleteMatching(partialKey *Point) (int, error) {
+
+	if partialKey == nil || partialKey.GetSize() != t.kSize {
+		return 0, errors.New("wrong key size")
+	}
+
+	return t.deleteNodes(t.partialSearchQuery(partialKey, t.root, make([]int32, 0, 10)))
+}
+
+// removes every node a Scan with the same bounds would return
+// and returns the number of removed nodes
+func (t *ArenaKDTree) DeleteRange(from *Point, to *Point) (int, error) {
+
+	r, err := NewRange(t.kSize, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.deleteNodes(t.scanQuery(t.root, r, make([]int32, 0, 10)))
+}
+
+func (t *ArenaKDTree) deleteNodes(nodes []int32) (int, error) {
+
+	// the keys are copied first since deleting moves
+	// keys into the slots which are still to visit
+	keys := make([]Point, len(nodes))
+	for i, n := range nodes {
+		keys[i] = t.pointAt(n)
+	}
+
+	for i := range keys {
+		if err := t.Delete(&keys[i]); err != nil {
+			return i, err
+		}
+	}
+
+	return len(keys), nil
+}
+
+// deletes like KDTree.deleteNode, the node takes over key and value
+// of its replacement and the slot of the removed leaf is freed
+func (t *ArenaKDTree) deleteNode(parent int32, n int32) {
+
+	for t.nodes[n].left != noNode || t.nodes[n].right != noNode {
+
+		if t.nodes[n].right == noNode {
+			t.nodes[n].right = t.nodes[n].left
+			t.nodes[n].left = noNode
+		}
+
+		minParent, min := t.searchMinimum(n, t.nodes[n].right, t.nodes[n].axis)
+
+		copy(t.keyAt(n), t.keyAt(min))
+		t.nodes[n].value = t.nodes[min].value
+
+		parent, n = minParent, min
+	}
+
+	if parent == noNode {
+		t.root = noNode
+	} else if t.nodes[parent].left == n {
+		t.nodes[parent].left = noNode
+	} else {
+		t.nodes[parent].right = noNode
+	}
+
+	t.free = append(t.free, n)
+}
+
+// returns the node with the minimal coordinate on
+// axis in the subtree n and its parent
+func (t *ArenaKDTree) searchMinimum(parent int32, n int32, axis int32) (int32, int32) {
+
+	type frame struct{ parent, node int32 }
+
+	minimum := frame{parent, n}
+	stack := []frame{minimum}
+
+	for len(stack) > 0 {
+
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if t.keyAt(f.node)[axis] < t.keyAt(minimum.node)[axis] {
+			minimum = f
+		}
+
+		node := t.nodes[f.node]
+
+		if node.left != noNode {
+			stack = append(stack, frame{f.node, node.left})
+		}
+
+		if node.right != noNode && node.axis != axis {
+			stack = append(stack, frame{f.node, node.right})
+		}
+	}
+
+	return minimum.parent, minimum.node
+}
+
+func (t *ArenaKDTree) Scan(from *Point, to *Point) ([]Value, error) {
+
+	r, err := NewRange(t.kSize, from, to)
+	if err != nil {
+		return make([]Value, 0), err
+	}
+
+	return t.ScanRange(r)
+}
+
+func (t *ArenaKDTree) ScanRange(r *Range) ([]Value, error) {
+
+	if r == nil || r.GetSize() != t.kSize {
+		return make([]Value, 0), errors.New("wrong range size")
+	}
+
+	return t.nodeValues(t.scanQuery(t.root, r, make([]int32, 0, 10))), nil
+}
+
+func (t *ArenaKDTree) scanQuery(n int32, r *Range, nodes []int32) []int32 {
+
+	if n == noNode {
+		return nodes
+	}
+
+	axis := int(t.nodes[n].axis)
+	split := t.splitValue(n)
+
+	if r.reachesBelow(axis, split) {
+		nodes = t.scanQuery(t.nodes[n].left, r, nodes)
+	}
+
+	if r.reachesFrom(axis, split) {
+		nodes = t.scanQuery(t.nodes[n].right, r, nodes)
+	}
+
+	if isKeyWithin(t.keyAt(n), r) {
+		nodes = append(nodes, n)
+	}
+
+	return nodes
+}
+
+func (t *ArenaKDTree) GetNN(key *Point) (Value, error) {
+
+	return t.GetNNWithOptions(key, nil)
+}
+
+// like KDTree.GetNNWithOptions
+func (t *ArenaKDTree) GetNNWithOptions(key *Point, options *NNOptions) (Value, error) {
+
+	values, err := t.GetKNNWithOptions(key, 1, options)
+
+	if err != nil {
+		return *new(Value), err
+	}
+
+	if len(values) == 0 {
+		return *new(Value), errors.New("no key passes the filter")
+	}
+
+	return values[0], nil
+}
+
+// returns the values of the k nearest neighbours of key ordered by
+// ascending distance, fewer if the tree holds less than k keys
+func (t *ArenaKDTree) GetKNN(key *Point, k int) ([]Value, error) {
+
+	return t.GetKNNWithOptions(key, k, nil)
+}
+
+// like KDTree.GetKNNWithOptions. Without bounding boxes subtrees are
+// pruned by the distance to their splitting plane only, and brute force
+// searches run on a single goroutine.
+func (t *ArenaKDTree) GetKNNWithOptions(key *Point, k int, options *NNOptions) ([]Value, error) {
+
+	if t.root == noNode {
+		return make([]Value, 0), errors.New("Tree is empty!")
+	}
+
+	if key == nil || key.GetSize() != t.kSize {
+		return make([]Value, 0), errors.New("Wrong or nil key!")
+	}
+
+	// None coordinates are ignored, but one is needed
+	if key.IsEmpty() {
+		return make([]Value, 0), errors.New("key has no coordinates")
+	}
+
+	if k < 1 {
+		return make([]Value, 0), errors.New("k has to be at least 1")
+	}
+
+	if options == nil {
+		options = &NNOptions{}
+	}
+
+	if err := options.check(t.kSize); err != nil {
+		return make([]Value, 0), err
+	}
+
+	search := &nnSearch{key: key, options: *options, neighbours: newNeighbourHeap(k)}
+
+	if options.BruteForce {
+		t.bruteForceKNN(search)
+	} else {
+		t.nearestNeighbour(search, t.root)
+	}
+
+	return search.neighbours.sorted(), nil
+}
+
+// reports whether the entry of node n may be returned
+func (t *ArenaKDTree) accepts(s *nnSearch, n int32) bool {
+
+	if s.options.Filter != nil && !isPartiallyEqualTo(s.options.Filter, t.keyAt(n)) {
+		return false
+	}
+
+	if s.options.Accept == nil {
+		return true
+	}
+
+	key := t.pointAt(n)
+	return s.options.Accept(&key, t.nodes[n].value)
+}
+
+func (t *ArenaKDTree) offer(s *nnSearch, n int32) {
+
+	if t.accepts(s, n) {
+		s.neighbours.offer(t.nodes[n].value, s.key.GetSquaredDistanceTo(t.keyAt(n)))
+	}
+}
+
+func (t *ArenaKDTree) nearestNeighbour(s *nnSearch, n int32) {
+
+	if n == noNode || s.isExhausted() {
+		return
+	}
+
+	s.visits++
+	t.offer(s, n)
+
+	axis := int(t.nodes[n].axis)
+	split := t.splitValue(n)
+	_, kv := s.key.GetKeyAt(axis)
+
+	// subtrees without keys matching the filter are skipped
+	left, right := t.nodes[n].left, t.nodes[n].right
+	if visitLeft, visitRight := s.options.filterBranches(axis, split); !visitLeft {
+		left = noNode
+	} else if !visitRight {
+		right = noNode
+	}
+
+	nextBranch, alternativeBranch := right, left
+	if kv.Value < split {
+		nextBranch, alternativeBranch = left, right
+	}
+
+	t.nearestNeighbour(s, nextBranch)
+
+	// squared distance to the splitting plane, a None coordinate
+	// of the key does not restrict the distance and never prunes
+	dist := 0.0
+	if kv.IsSome {
+		dist = squaredDelta(split, kv.Value)
+	}
+
+	if scale := 1 + s.options.Epsilon; dist*scale*scale <= s.neighbours.bound() {
+		t.nearestNeighbour(s, alternativeBranch)
+	}
+}
+
+// offers every reachable node, freed slots are skipped
+func (t *ArenaKDTree) bruteForceKNN(s *nnSearch) {
+
+	stack := []int32{t.root}
+
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if n == noNode {
+			continue
+		}
+
+		t.offer(s, n)
+		stack = append(stack, t.nodes[n].left, t.nodes[n].right)
+	}
+}
+
+// checks the k-d tree invariant like KDTree.Validate and
+// that every slot is either reachable or free
+func (t *ArenaKDTree) Validate() error {
+
+	type boundedFrame struct {
+		depth int
+		node  int32
+		cell  *cell
+	}
+
+	reachable := 0
+
+	if t.root != noNode {
+		stack := []boundedFrame{{depth: 0, node: t.root, cell: newCell(t.kSize)}}
+
+		for len(stack) > 0 {
+
+			frame := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			node := t.nodes[frame.node]
+			reachable++
+
+			if int(node.axis) != frame.depth%t.kSize {
+				return fmt.Errorf("node at depth %d has axis %d", frame.depth, node.axis)
+			}
+
+			for d, v := range t.keyAt(frame.node) {
+				if v < frame.cell.lower[d] || (frame.cell.bounded[d] && v >= frame.cell.upper[d]) {
+					return fmt.Errorf("node at depth %d violates the bounds of axis %d", frame.depth, d)
+				}
+			}
+
+			split := t.splitValue(frame.node)
+
+			if node.left != noNode {
+				left := frame.cell.clone()
+				left.toLeft(int(node.axis), split)
+				stack = append(stack, boundedFrame{depth: frame.depth + 1, node: node.left, cell: left})
+			}
+
+			if node.right != noNode {
+				right := frame.cell.clone()
+				right.toRight(int(node.axis), split)
+				stack = append(stack, boundedFrame{depth: frame.depth + 1, node: node.right, cell: right})
+			}
+		}
+	}
+
+	if reachable+len(t.free) != len(t.nodes) {
+		return fmt.Errorf("%d reachable and %d free nodes but %d slots", reachable, len(t.free), len(t.nodes))
+	}
+
+	return nil
+}
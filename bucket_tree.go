@@ -0,0 +1,487 @@
+/**
+bucket_tree.go
+k-d tree variant with bucket leaves and sliding midpoint splits
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// BucketKDTree stores keys only in its leaves. A leaf holds up to
+// bucketSize keys with their coordinates in one contiguous slice and
+// their values in another, internal nodes only hold the split plane.
+// A full leaf is split at the midpoint of the widest side of the
+// bounding box of its keys. If this leaves one side empty, the plane
+// slides to the closest key, so both leaves keep at least one key.
+//
+// Keys are kept in insertion order within a leaf and equal keys always
+// end up in the same leaf, so exact key operations act on the oldest
+// entry stored under a key, like on the KDTree.
+type BucketKDTree struct {
+	kSize      int
+	bucketSize int
+	count      int
+	root       *bucketNode
+}
+
+type bucketNode struct {
+	// internal nodes, keys smaller than split go left
+	axis  int
+	split uint64
+	left  *bucketNode
+	right *bucketNode
+
+	// leaves, key i is at coords[i*kSize : (i+1)*kSize]
+	coords []uint64
+	values []Value
+}
+
+func NewBucketKDTree(keySize int, bucketSize int) (*BucketKDTree, error) {
+	if keySize < 1 {
+		return nil, errors.New("key size has to be at least 1")
+	}
+
+	if bucketSize < 0 {
+		return nil, errors.New("bucket size cannot be negative")
+	}
+
+	if bucketSize == 0 {
+		bucketSize = 16
+	}
+
+	return &BucketKDTree{kSize: keySize, bucketSize: bucketSize, root: &bucketNode{}}, nil
+}
+
+func (n *bucketNode) isLeaf() bool {
+	return n.left == nil
+}
+
+func (n *bucketNode) keyAt(i int, kSize int) []uint64 {
+	return n.coords[i*kSize : (i+1)*kSize]
+}
+
+func (n *bucketNode) isKeyEqual(i int, kSize int, key *Point) bool {
+	for d, k := range n.keyAt(i, kSize) {
+		if k != key.coords[d].Value {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *BucketKDTree) Put(key *Point, value Value) error {
+
+	if key == nil || key.GetSize() != t.kSize || key.IsPartial() {
+		return errors.New("Wrong key!")
+	}
+
+	leaf := t.root
+	for !leaf.isLeaf() {
+		leaf = leaf.child(key)
+	}
+
+	for _, k := range key.coords {
+		leaf.coords = append(leaf.coords, k.Value)
+	}
+	leaf.values = append(leaf.values, value)
+	t.count++
+
+	if len(leaf.values) > t.bucketSize {
+		t.splitLeaf(leaf)
+	}
+
+	return nil
+}
+
+// returns the child the key belongs to
+func (n *bucketNode) child(key *Point) *bucketNode {
+	if key.coords[n.axis].Value < n.split {
+		return n.left
+	}
+	return n.right
+}
+
+// turns a full leaf into an internal node with two leaves
+func (t *BucketKDTree) splitLeaf(leaf *bucketNode) {
+
+	count := len(leaf.values)
+
+	// widest side of the bounding box
+	axis := 0
+	var lower, upper uint64
+	for d := 0; d < t.kSize; d++ {
+		min, max := uint64(math.MaxUint64), uint64(0)
+		for i := 0; i < count; i++ {
+			v := leaf.coords[i*t.kSize+d]
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+		if d == 0 || max-min > upper-lower {
+			axis, lower, upper = d, min, max
+		}
+	}
+
+	// all keys are equal, the leaf stays over full
+	if lower == upper {
+		return
+	}
+
+	split := lower + (upper-lower)/2
+
+	// slide to the closest key above, if the left side would be empty
+	if split == lower {
+		split = upper
+		for i := 0; i < count; i++ {
+			if v := leaf.coords[i*t.kSize+axis]; v > lower && v < split {
+				split = v
+			}
+		}
+	}
+
+	left := &bucketNode{}
+	right := &bucketNode{}
+
+	for i := 0; i < count; i++ {
+		side := right
+		if leaf.coords[i*t.kSize+axis] < split {
+			side = left
+		}
+		side.coords = append(side.coords, leaf.keyAt(i, t.kSize)...)
+		side.values = append(side.values, leaf.values[i])
+	}
+
+	leaf.axis = axis
+	leaf.split = split
+	leaf.left = left
+	leaf.right = right
+	leaf.coords = nil
+	leaf.values = nil
+
+	// one side may still be over full
+	for _, child := range []*bucketNode{left, right} {
+		if len(child.values) > t.bucketSize {
+			t.splitLeaf(child)
+		}
+	}
+}
+
+func (t *BucketKDTree) Get(key *Point) ([]Value, error) {
+
+	if key.GetSize() != t.kSize {
+		return make([]Value, 0), errors.New("wrong key size")
+	}
+
+	if key.IsPartial() {
+		return t.partialSearchQuery(key, t.root, make([]Value, 0, 10)), nil
+	}
+
+	leaf, index := t.searchQuery(key)
+	if index < 0 {
+		return make([]Value, 0), errors.New("Couldn't find key")
+	}
+
+	return []Value{leaf.values[index]}, nil
+}
+
+// returns the leaf the key belongs to and the index
+// of its oldest entry with the key, or -1
+func (t *BucketKDTree) searchQuery(key *Point) (*bucketNode, int) {
+
+	leaf := t.root
+	for !leaf.isLeaf() {
+		leaf = leaf.child(key)
+	}
+
+	for i := range leaf.values {
+		if leaf.isKeyEqual(i, t.kSize, key) {
+			return leaf, i
+		}
+	}
+
+	return leaf, -1
+}
+
+func (t *BucketKDTree) partialSearchQuery(key *Point, node *bucketNode, values []Value) []Value {
+
+	if node.isLeaf() {
+		for i := range node.values {
+			if isPartiallyEqualTo(key, node.keyAt(i, t.kSize)) {
+				values = append(values, node.values[i])
+			}
+		}
+		return values
+	}
+
+	_, kv := key.GetKeyAt(node.axis)
+
+	if !kv.IsSome || kv.Value < node.split {
+		values = t.partialSearchQuery(key, node.left, values)
+	}
+
+	if !kv.IsSome || kv.Value >= node.split {
+		values = t.partialSearchQuery(key, node.right, values)
+	}
+
+	return values
+}
+
+func isPartiallyEqualTo(key *Point, coords []uint64) bool {
+	for i, k := range key.coords {
+		if k.IsSome && k.Value != coords[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *BucketKDTree) Delete(key *Point) error {
+
+	if key == nil || key.GetSize() != t.kSize || key.IsPartial() {
+		return errors.New("Wrong key!")
+	}
+
+	// keep track of the parents to collapse empty leaves
+	var parent, grandParent *bucketNode
+	leaf := t.root
+	for !leaf.isLeaf() {
+		grandParent, parent = parent, leaf
+		leaf = leaf.child(key)
+	}
+
+	index := -1
+	for i := range leaf.values {
+		if leaf.isKeyEqual(i, t.kSize, key) {
+			index = i
+			break
+		}
+	}
+
+	if index < 0 {
+		return errors.New("node to delete not found")
+	}
+
+	leaf.coords = append(leaf.coords[:index*t.kSize], leaf.coords[(index+1)*t.kSize:]...)
+	leaf.values = append(leaf.values[:index], leaf.values[index+1:]...)
+	t.count--
+
+	// an empty leaf is removed, its sibling takes the place of the parent
+	if len(leaf.values) == 0 && parent != nil {
+		sibling := parent.left
+		if sibling == leaf {
+			sibling = parent.right
+		}
+
+		if grandParent == nil {
+			t.root = sibling
+		} else if grandParent.left == parent {
+			grandParent.left = sibling
+		} else {
+			grandParent.right = sibling
+		}
+	}
+
+	return nil
+}
+
+func (t *BucketKDTree) Upsert(key *Point, value Value) error {
+
+	if key == nil || key.GetSize() != t.kSize || key.IsPartial() {
+		return errors.New("Wrong key!")
+	}
+
+	leaf, index := t.searchQuery(key)
+	if index < 0 {
+		return errors.New("Couldnt find node to upsert")
+	}
+
+	leaf.values[index] = value
+
+	return nil
+}
+
+func (t *BucketKDTree) Scan(from *Point, to *Point) ([]Value, error) {
+
+	r, err := NewRange(t.kSize, from, to)
+	if err != nil {
+		return make([]Value, 0), err
+	}
+
+	return t.ScanRange(r)
+}
+
+func (t *BucketKDTree) ScanRange(r *Range) ([]Value, error) {
+
+	if r == nil || r.GetSize() != t.kSize {
+		return make([]Value, 0), errors.New("wrong range size")
+	}
+
+	return t.scanQuery(t.root, r, make([]Value, 0, 10)), nil
+}
+
+func (t *BucketKDTree) scanQuery(node *bucketNode, r *Range, values []Value) []Value {
+
+	if node.isLeaf() {
+		for i := range node.values {
+			if isKeyWithin(node.keyAt(i, t.kSize), r) {
+				values = append(values, node.values[i])
+			}
+		}
+		return values
+	}
+
+	if r.reachesBelow(node.axis, node.split) {
+		values = t.scanQuery(node.left, r, values)
+	}
+
+	if r.reachesFrom(node.axis, node.split) {
+		values = t.scanQuery(node.right, r, values)
+	}
+
+	return values
+}
+
+// like Point.IsWithin for the coordinates of a stored key
+func isKeyWithin(coords []uint64, r *Range) bool {
+	for i, v := range coords {
+		if !r.containsAt(i, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *BucketKDTree) GetNN(key *Point) (Value, error) {
+
+	values, err := t.GetKNN(key, 1)
+
+	if err != nil {
+		return *new(Value), err
+	}
+
+	return values[0], nil
+}
+
+// returns the values of the k nearest neighbours of key ordered by
+// ascending distance, fewer if the tree holds less than k keys
+func (t *BucketKDTree) GetKNN(key *Point, k int) ([]Value, error) {
+
+	if t.count == 0 {
+		return make([]Value, 0), errors.New("Tree is empty!")
+	}
+
+	if key == nil || key.GetSize() != t.kSize {
+		return make([]Value, 0), errors.New("Wrong or nil key!")
+	}
+
+	// None coordinates are ignored, but one is needed
+	if key.IsEmpty() {
+		return make([]Value, 0), errors.New("key has no coordinates")
+	}
+
+	if k < 1 {
+		return make([]Value, 0), errors.New("k has to be at least 1")
+	}
+
+	neighbours := newNeighbourHeap(k)
+	t.nearestNeighbour(key, t.root, neighbours)
+
+	return neighbours.sorted(), nil
+}
+
+func (t *BucketKDTree) nearestNeighbour(key *Point, node *bucketNode, neighbours *neighbourHeap) {
+
+	if node.isLeaf() {
+		for i := range node.values {
+			neighbours.offer(node.values[i], key.GetSquaredDistanceTo(node.keyAt(i, t.kSize)))
+		}
+		return
+	}
+
+	_, kv := key.GetKeyAt(node.axis)
+
+	nextBranch, alternativeBranch := node.right, node.left
+	if kv.Value < node.split {
+		nextBranch, alternativeBranch = node.left, node.right
+	}
+
+	t.nearestNeighbour(key, nextBranch, neighbours)
+
+	// squared distance to the splitting plane, a None coordinate
+	// of the key does not restrict the distance and never prunes
+	dist := 0.0
+	if kv.IsSome {
+		dist = squaredDelta(node.split, kv.Value)
+	}
+
+	if dist <= neighbours.bound() {
+		t.nearestNeighbour(key, alternativeBranch, neighbours)
+	}
+}
+
+// checks that every key lies on the correct side of all splits
+// of its ancestors and that no leaf but the root is empty
+func (t *BucketKDTree) Validate() error {
+
+	type boundedFrame struct {
+		node *bucketNode
+		cell *cell
+	}
+
+	count := 0
+	stack := []boundedFrame{{node: t.root, cell: newCell(t.kSize)}}
+
+	for len(stack) > 0 {
+
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node := frame.node
+
+		if node.isLeaf() {
+			if len(node.values) == 0 && node != t.root {
+				return errors.New("empty leaf below the root")
+			}
+
+			if len(node.coords) != len(node.values)*t.kSize {
+				return fmt.Errorf("leaf holds %d coordinates for %d values", len(node.coords), len(node.values))
+			}
+
+			for i := range node.values {
+				key := node.keyAt(i, t.kSize)
+				for d, v := range key {
+					if v < frame.cell.lower[d] || (frame.cell.bounded[d] && v >= frame.cell.upper[d]) {
+						return fmt.Errorf("key %v violates the bounds of axis %d", key, d)
+					}
+				}
+			}
+
+			count += len(node.values)
+			continue
+		}
+
+		if node.right == nil {
+			return errors.New("internal node without right child")
+		}
+
+		left := frame.cell.clone()
+		left.toLeft(node.axis, node.split)
+		right := frame.cell.clone()
+		right.toRight(node.axis, node.split)
+
+		stack = append(stack, boundedFrame{node: node.left, cell: left}, boundedFrame{node: node.right, cell: right})
+	}
+
+	if count != t.count {
+		return fmt.Errorf("tree counts %d keys but leaves hold %d", t.count, count)
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+/**
+export.go
+Dumps of a KDTree for debugging, as Graphviz DOT, nested JSON and text
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// writes the tree as a Graphviz digraph, every node labeled with its
+// key, split axis and subtree count. Nodes are numbered in pre-order.
+func (t *KDTree) WriteDOT(w io.Writer) error {
+
+	b := bufio.NewWriter(w)
+
+	fmt.Fprintln(b, "digraph kdtree {")
+	fmt.Fprintln(b, "\tnode [shape=box];")
+
+	id := 0
+	var write func(node *Node) int
+	write = func(node *Node) int {
+		self := id
+		id++
+
+		fmt.Fprintf(b, "\tn%d [label=\"%s\\naxis %d, count %d\"];\n", self, formatPoint(&node.Key), node.axis, node.count)
+
+		if node.Left != nil {
+			fmt.Fprintf(b, "\tn%d -> n%d [label=\"< %d\"];\n", self, write(node.Left), node.SplitValue())
+		}
+		if node.Right != nil {
+			fmt.Fprintf(b, "\tn%d -> n%d [label=\">= %d\"];\n", self, write(node.Right), node.SplitValue())
+		}
+
+		return self
+	}
+
+	if t.root != nil {
+		write(t.root)
+	}
+
+	fmt.Fprintln(b, "}")
+
+	return b.Flush()
+}
+
+type jsonNode struct {
+	Key   []uint64  `json:"key"`
+	Value string    `json:"value"` // hex encoded
+	Axis  int       `json:"axis"`
+	Count int       `json:"count"`
+	Min   []uint64  `json:"min"` // bounding box of the subtree
+	Max   []uint64  `json:"max"`
+	Left  *jsonNode `json:"left,omitempty"`
+	Right *jsonNode `json:"right,omitempty"`
+}
+
+func newJSONNode(node *Node) *jsonNode {
+
+	if node == nil {
+		return nil
+	}
+
+	key := make([]uint64, len(node.Key.coords))
+	for i, k := range node.Key.coords {
+		key[i] = k.Value
+	}
+
+	value := node.GetValue()
+
+	return &jsonNode{
+		Key:   key,
+		Value: hex.EncodeToString(value[:]),
+		Axis:  node.axis,
+		Count: node.count,
+		Min:   node.box.Min,
+		Max:   node.box.Max,
+		Left:  newJSONNode(node.Left),
+		Right: newJSONNode(node.Right),
+	}
+}
+
+// writes the tree as nested JSON objects, null for an empty tree
+func (t *KDTree) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(newJSONNode(t.root))
+}
+
+// writes the tree as indented text, one node per line,
+// children are marked with L and R. Meant for small trees.
+func (t *KDTree) PrettyPrint(w io.Writer) error {
+
+	b := bufio.NewWriter(w)
+
+	if t.root == nil {
+		fmt.Fprintln(b, "(empty)")
+		return b.Flush()
+	}
+
+	var write func(node *Node, side string, indent string)
+	write = func(node *Node, side string, indent string) {
+
+		fmt.Fprintf(b, "%s%s%s axis %d count %d\n", indent, side, formatPoint(&node.Key), node.axis, node.count)
+
+		indent += strings.Repeat(" ", len(side))
+
+		if node.Left != nil {
+			write(node.Left, "L ", indent)
+		}
+		if node.Right != nil {
+			write(node.Right, "R ", indent)
+		}
+	}
+
+	write(t.root, "", "")
+
+	return b.Flush()
+}
+
+// formats the coordinates of key like (1, 2, _), None as _
+func formatPoint(key *Point) string {
+
+	coords := make([]string, len(key.coords))
+	for i, k := range key.coords {
+		if k.IsSome {
+			coords[i] = fmt.Sprint(k.Value)
+		} else {
+			coords[i] = "_"
+		}
+	}
+
+	return "(" + strings.Join(coords, ", ") + ")"
+}
@@ -0,0 +1,150 @@
+/**
+farthest.go
+Farthest and reverse nearest neighbour queries
+*/
+
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// returns the value of the key farthest away from key. None coordinates
+// of key are ignored like in GetKNN. Subtrees whose box cannot hold a
+// key farther away than the current one are skipped.
+func (t *KDTree) GetFarthest(key *Point) (Value, error) {
+
+	if t.root == nil {
+		return *new(Value), errors.New("Tree is empty!")
+	}
+
+	if key == nil || key.GetSize() != t.kSize {
+		return *new(Value), errors.New("Wrong or nil key!")
+	}
+
+	if key.IsEmpty() {
+		return *new(Value), errors.New("key has no coordinates")
+	}
+
+	farthest := t.root
+	_, max := key.GetSquaredDistance(&t.root.Key)
+
+	t.farthestQuery(t.root, key, &farthest, &max)
+
+	return farthest.GetValue(), nil
+}
+
+func (t *KDTree) farthestQuery(node *Node, key *Point, farthest **Node, max *float64) {
+
+	if node == nil || node.box.maxSquaredDistance(key) <= *max {
+		return
+	}
+
+	if _, distance := key.GetSquaredDistance(&node.Key); distance > *max {
+		*farthest, *max = node, distance
+	}
+
+	// the subtree on the other side of the split is visited first,
+	// it usually holds the farther keys
+	_, kv := key.GetKeyAt(node.axis)
+
+	if kv.Value >= node.SplitValue() {
+		t.farthestQuery(node.Left, key, farthest, max)
+		t.farthestQuery(node.Right, key, farthest, max)
+	} else {
+		t.farthestQuery(node.Right, key, farthest, max)
+		t.farthestQuery(node.Left, key, farthest, max)
+	}
+}
+
+// returns the values of all keys key would be the nearest neighbour of,
+// i.e. which are at most as far from key as from any other stored key.
+// Subtrees whose box lies farther away from key than the keys in the
+// box can be from the root of the subtree are skipped.
+func (t *KDTree) GetReverseNN(key *Point) ([]Value, error) {
+
+	if t.root == nil {
+		return make([]Value, 0), errors.New("Tree is empty!")
+	}
+
+	// distances between stored keys take all coordinates into account
+	if key == nil || key.GetSize() != t.kSize || key.IsPartial() {
+		return make([]Value, 0), errors.New("Wrong or nil key!")
+	}
+
+	search := &nnSearch{neighbours: newNeighbourHeap(2)}
+
+	return nodeValues(t.reverseNNQuery(t.root, key, search, make([]*Node, 0))), nil
+}
+
+func (t *KDTree) reverseNNQuery(node *Node, key *Point, search *nnSearch, nodes []*Node) []*Node {
+
+	if node == nil {
+		return nodes
+	}
+
+	// every key of the subtree has node, or for node itself one of its
+	// descendants, at most this far away
+	if node.count > 1 && node.box.minSquaredDistance(key) > node.box.maxSquaredDistance(&node.Key) {
+		return nodes
+	}
+
+	nodes = t.reverseNNQuery(node.Left, key, search, nodes)
+	nodes = t.reverseNNQuery(node.Right, key, search, nodes)
+
+	if _, distance := key.GetSquaredDistance(&node.Key); distance <= t.secondNearest(search, &node.Key) {
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+// returns the squared distance of the nearest key to key other than
+// the stored key itself, infinity if there is none
+func (t *KDTree) secondNearest(search *nnSearch, key *Point) float64 {
+
+	// the key itself is at distance 0, as are its duplicates
+	search.key = key
+	search.visits = 0
+	search.neighbours.reset(2)
+
+	t.nearestNeighbour(search, t.root)
+
+	return search.neighbours.bound()
+}
+
+// returns the smallest squared distance of p to a point of the box,
+// None coordinates of p are ignored
+func (b *BoundingBox) minSquaredDistance(p *Point) float64 {
+
+	sum := 0.0
+
+	for i, k := range p.coords {
+		if !k.IsSome {
+			continue
+		}
+
+		if k.Value < b.Min[i] {
+			sum += squaredDelta(k.Value, b.Min[i])
+		} else if k.Value > b.Max[i] {
+			sum += squaredDelta(k.Value, b.Max[i])
+		}
+	}
+
+	return sum
+}
+
+// like minSquaredDistance, but to the farthest point of the box
+func (b *BoundingBox) maxSquaredDistance(p *Point) float64 {
+
+	sum := 0.0
+
+	for i, k := range p.coords {
+		if k.IsSome {
+			sum += math.Max(squaredDelta(k.Value, b.Min[i]), squaredDelta(k.Value, b.Max[i]))
+		}
+	}
+
+	return sum
+}
@@ -0,0 +1,278 @@
+/**
+forest.go
+Randomized k-d forest for approximate nearest neighbour search in high dimensions
+*/
+
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+type KDForestOptions struct {
+	Trees         int   // number of trees, 4 if 0
+	CandidateAxes int   // split axes are drawn among this many highest variance dimensions, 5 if 0
+	Seed          int64 // seed of the split axis selection
+}
+
+// KDForest holds every entry in several k-d trees. Each node of each tree
+// splits on an axis drawn at random among the dimensions with the highest
+// variance at the time of insertion, so the trees partition the space
+// differently and a point missed by one tree is likely found by another.
+// All trees are searched together, always continuing with the closest
+// unexplored branch of any tree.
+type KDForest struct {
+	kSize         int
+	candidateAxes int
+	random        *rand.Rand
+	roots         []*forestNode
+	stats         keyStatistics
+}
+
+// entries are shared by all trees
+type forestEntry struct {
+	key   Point
+	value Value
+}
+
+type forestNode struct {
+	entry *forestEntry
+	axis  int
+
+	left  *forestNode
+	right *forestNode
+}
+
+// search over all trees of a forest
+type forestSearch struct {
+	nnSearch
+	queue branchQueue
+	seen  map[*forestEntry]bool
+}
+
+func NewKDForest(keySize int, options *KDForestOptions) (*KDForest, error) {
+	if keySize < 1 {
+		return nil, errors.New("key size has to be at least 1")
+	}
+
+	if options == nil {
+		options = &KDForestOptions{}
+	}
+
+	if options.Trees < 0 || options.CandidateAxes < 0 {
+		return nil, errors.New("Trees and CandidateAxes cannot be negative")
+	}
+
+	trees := options.Trees
+	if trees == 0 {
+		trees = 4
+	}
+
+	candidateAxes := options.CandidateAxes
+	if candidateAxes == 0 {
+		candidateAxes = 5
+	}
+	if candidateAxes > keySize {
+		candidateAxes = keySize
+	}
+
+	return &KDForest{
+		kSize:         keySize,
+		candidateAxes: candidateAxes,
+		random:        rand.New(rand.NewSource(options.Seed)),
+		roots:         make([]*forestNode, trees),
+		stats:         newKeyStatistics(keySize),
+	}, nil
+}
+
+func (f *KDForest) Put(key *Point, value Value) error {
+
+	if key == nil || key.GetSize() != f.kSize || key.IsPartial() {
+		return errors.New("Wrong key!")
+	}
+
+	entry := &forestEntry{key: *key, value: value}
+
+	f.stats.add(key)
+
+	axes := f.highestVarianceAxes()
+
+	for i := range f.roots {
+		node := &forestNode{entry: entry, axis: axes[f.random.Intn(len(axes))]}
+
+		if f.roots[i] == nil {
+			f.roots[i] = node
+			continue
+		}
+
+		current := f.roots[i]
+		for {
+			if node.coordAt(current.axis) < current.split() {
+				if current.left == nil {
+					current.left = node
+					break
+				}
+				current = current.left
+			} else {
+				if current.right == nil {
+					current.right = node
+					break
+				}
+				current = current.right
+			}
+		}
+	}
+
+	return nil
+}
+
+// returns the candidateAxes dimensions with the highest variance
+func (f *KDForest) highestVarianceAxes() []int {
+
+	variances := make([]float64, f.kSize)
+	axes := make([]int, f.kSize)
+
+	for i := range axes {
+		variances[i] = f.stats.variance(i)
+		axes[i] = i
+	}
+
+	sort.SliceStable(axes, func(i, j int) bool { return variances[axes[i]] > variances[axes[j]] })
+
+	return axes[:f.candidateAxes]
+}
+
+func (f *KDForest) GetNN(key *Point) (Value, error) {
+
+	return f.GetNNWithOptions(key, nil)
+}
+
+// nil options request an exact search, which is slower than on a single
+// tree. Use MaxVisits to bound the number of nodes visited over all trees.
+func (f *KDForest) GetNNWithOptions(key *Point, options *NNOptions) (Value, error) {
+
+	values, err := f.GetKNNWithOptions(key, 1, options)
+
+	if err != nil {
+		return *new(Value), err
+	}
+
+	if len(values) == 0 {
+		return *new(Value), errors.New("no key passes the filter")
+	}
+
+	return values[0], nil
+}
+
+func (f *KDForest) GetKNN(key *Point, k int) ([]Value, error) {
+
+	return f.GetKNNWithOptions(key, k, nil)
+}
+
+func (f *KDForest) GetKNNWithOptions(key *Point, k int, options *NNOptions) ([]Value, error) {
+
+	if f.stats.count == 0 {
+		return make([]Value, 0), errors.New("Forest is empty!")
+	}
+
+	if key == nil || key.GetSize() != f.kSize {
+		return make([]Value, 0), errors.New("Wrong or nil key!")
+	}
+
+	// None coordinates are ignored, but one is needed
+	if key.IsEmpty() {
+		return make([]Value, 0), errors.New("key has no coordinates")
+	}
+
+	if k < 1 {
+		return make([]Value, 0), errors.New("k has to be at least 1")
+	}
+
+	if options == nil {
+		options = &NNOptions{}
+	}
+
+	if err := options.check(f.kSize); err != nil {
+		return make([]Value, 0), err
+	}
+
+	search := &forestSearch{
+		nnSearch: nnSearch{key: key, options: *options, neighbours: newNeighbourHeap(k)},
+		queue:    make(branchQueue, 0, 64),
+		seen:     make(map[*forestEntry]bool),
+	}
+
+	for _, root := range f.roots {
+		search.descend(root, 0)
+	}
+
+	for search.queue.Len() > 0 && !search.isExhausted() {
+		next := heap.Pop(&search.queue).(branch)
+
+		if scale := 1 + search.options.Epsilon; next.distance*scale*scale > search.neighbours.bound() {
+			break
+		}
+
+		search.descend(next.node, next.distance)
+	}
+
+	return search.neighbours.sorted(), nil
+}
+
+// follows the branches closer to the key down to a leaf and
+// queues the other branches with a lower bound of their squared distance
+func (s *forestSearch) descend(node *forestNode, bound float64) {
+
+	for node != nil && !s.isExhausted() {
+
+		s.visits++
+
+		if !s.seen[node.entry] {
+			s.seen[node.entry] = true
+			if s.options.accepts(&node.entry.key, node.entry.value) {
+				_, distance := s.key.GetSquaredDistance(&node.entry.key)
+				s.neighbours.offer(node.entry.value, distance)
+			}
+		}
+
+		_, kv := s.key.GetKeyAt(node.axis)
+		split := node.split()
+
+		// subtrees without keys matching the filter are skipped
+		left, right := node.left, node.right
+		if visitLeft, visitRight := s.options.filterBranches(node.axis, split); !visitLeft {
+			left = nil
+		} else if !visitRight {
+			right = nil
+		}
+
+		near, far := right, left
+		if kv.Value < split {
+			near, far = left, right
+		}
+
+		// a None coordinate of the key never prunes
+		farBound := bound
+		if kv.IsSome {
+			farBound = math.Max(bound, squaredDelta(split, kv.Value))
+		}
+
+		if scale := 1 + s.options.Epsilon; far != nil && farBound*scale*scale <= s.neighbours.bound() {
+			heap.Push(&s.queue, branch{node: far, distance: farBound})
+		}
+
+		node = near
+	}
+}
+
+func (n *forestNode) split() uint64 {
+	return n.coordAt(n.axis)
+}
+
+func (n *forestNode) coordAt(i int) uint64 {
+	return n.entry.key.coords[i].Value
+}
@@ -0,0 +1,308 @@
+/**
+join.go
+Spatial joins between two trees
+*/
+
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+type JoinPair struct {
+	Left     Value // value in the left tree
+	Right    Value // value in the right tree
+	Distance float64
+}
+
+// returns all pairs of a key of left and a key of right which are at most
+// distance apart, in no particular order. Both trees are traversed at once
+// and pairs of subtrees whose boxes lie farther apart are skipped.
+func JoinWithinDistance(left *KDTree, right *KDTree, distance float64) ([]JoinPair, error) {
+
+	if left == nil || right == nil || left.kSize != right.kSize {
+		return make([]JoinPair, 0), errors.New("trees need the same key size")
+	}
+
+	if distance < 0 || math.IsNaN(distance) {
+		return make([]JoinPair, 0), errors.New("distance cannot be negative")
+	}
+
+	j := &withinJoin{bound: distance * distance, pairs: make([]JoinPair, 0)}
+	j.visit(left.root, right.root)
+
+	return j.pairs, nil
+}
+
+type withinJoin struct {
+	bound float64 // squared distance
+	pairs []JoinPair
+}
+
+// joins the subtrees a of the left and b of the right tree. The subtree
+// with the larger box is split into its root, joined with the other
+// subtree, and its children, joined recursively.
+func (j *withinJoin) visit(a *Node, b *Node) {
+
+	if a == nil || b == nil || a.box.squaredDistanceTo(&b.box) > j.bound {
+		return
+	}
+
+	if splitsLeft(a, b) {
+		j.pointQuery(a, b, false)
+		j.visit(a.Left, b)
+		j.visit(a.Right, b)
+		return
+	}
+
+	j.pointQuery(b, a, true)
+	j.visit(a, b.Left)
+	j.visit(a, b.Right)
+}
+
+// pairs p with all keys of the subtree node,
+// swapped tells whether p belongs to the right tree
+func (j *withinJoin) pointQuery(p *Node, node *Node, swapped bool) {
+
+	if node == nil || node.box.minSquaredDistance(&p.Key) > j.bound {
+		return
+	}
+
+	if _, distance := p.Key.GetSquaredDistance(&node.Key); distance <= j.bound {
+		pair := JoinPair{Left: p.GetValue(), Right: node.GetValue(), Distance: math.Sqrt(distance)}
+		if swapped {
+			pair.Left, pair.Right = pair.Right, pair.Left
+		}
+		j.pairs = append(j.pairs, pair)
+	}
+
+	j.pointQuery(p, node.Left, swapped)
+	j.pointQuery(p, node.Right, swapped)
+}
+
+// returns one pair for every key of left with its nearest neighbour in
+// right, ordered like the nodes of left in pre-order. Both trees are
+// traversed at once like in JoinWithinDistance. Every subtree of left
+// keeps the largest distance of its keys to their nearest neighbour so
+// far, and subtrees of right whose box lies farther away are skipped.
+func JoinNearest(left *KDTree, right *KDTree) ([]JoinPair, error) {
+
+	if left == nil || right == nil || left.kSize != right.kSize {
+		return make([]JoinPair, 0), errors.New("trees need the same key size")
+	}
+
+	if left.root != nil && right.root == nil {
+		return make([]JoinPair, 0), errors.New("Tree is empty!")
+	}
+
+	queries := make([]joinQuery, 0, left.root.GetCount())
+	root, queries := newJoinQuery(left.root, queries)
+
+	j := &nearestJoin{right: right, search: &nnSearch{neighbours: newNeighbourHeap(1)}}
+	j.seed(root)
+	j.visit(root, right.root)
+
+	pairs := make([]JoinPair, len(queries))
+	for i, q := range queries {
+		pairs[i] = JoinPair{Left: q.node.GetValue(), Right: q.nearest.value, Distance: math.Sqrt(q.nearest.distance)}
+	}
+
+	return pairs, nil
+}
+
+// subtrees of left with at most this many keys are joined key by key,
+// splitting them further costs more than their bounds save
+const joinBucketSize = 64
+
+// nearest neighbour found so far for the key of a node of left,
+// its subtree is mirrored by left and right
+type joinQuery struct {
+	node        *Node
+	left, right *joinQuery
+	nearest     neighbour // at the maximal float until one is found
+	bound       float64   // largest nearest distance within the subtree
+}
+
+// appends the queries of the subtree node in pre-order,
+// queries needs the capacity for all of them
+func newJoinQuery(node *Node, queries []joinQuery) (*joinQuery, []joinQuery) {
+
+	if node == nil {
+		return nil, queries
+	}
+
+	queries = append(queries, joinQuery{
+		node:    node,
+		nearest: neighbour{distance: math.MaxFloat64},
+		bound:   math.MaxFloat64,
+	})
+	q := &queries[len(queries)-1]
+
+	q.left, queries = newJoinQuery(node.Left, queries)
+	q.right, queries = newJoinQuery(node.Right, queries)
+
+	return q, queries
+}
+
+func (q *joinQuery) updateBound() {
+
+	q.bound = q.nearest.distance
+	if q.left != nil && q.left.bound > q.bound {
+		q.bound = q.left.bound
+	}
+	if q.right != nil && q.right.bound > q.bound {
+		q.bound = q.right.bound
+	}
+}
+
+type nearestJoin struct {
+	right  *KDTree
+	search *nnSearch // reused by every point query
+}
+
+// starts every query with the nearest key on the path down right to the
+// cell of its key, without them the bounds only shrink deep down right
+func (j *nearestJoin) seed(q *joinQuery) {
+
+	if q == nil {
+		return
+	}
+
+	key := &q.node.Key
+
+	for node := j.right.root; node != nil; {
+		if _, distance := key.GetSquaredDistance(&node.Key); distance < q.nearest.distance {
+			q.nearest = neighbour{value: node.GetValue(), distance: distance}
+		}
+
+		if key.coords[node.axis].Value >= node.SplitValue() {
+			node = node.Right
+		} else {
+			node = node.Left
+		}
+	}
+
+	j.seed(q.left)
+	j.seed(q.right)
+
+	q.updateBound()
+}
+
+// joins the subtree q of left with the subtree node of right, splitting
+// the one with the larger box like withinJoin.visit. The children of
+// right are visited closer one first, so that the bounds shrink early.
+func (j *nearestJoin) visit(q *joinQuery, node *Node) {
+
+	if q == nil || node == nil || q.node.box.squaredDistanceTo(&node.box) > q.bound {
+		return
+	}
+
+	if q.node.count <= joinBucketSize {
+		j.pointQueries(q, node)
+		return
+	}
+
+	if splitsLeft(q.node, node) {
+		j.pointQuery(q, node)
+		j.visit(q.left, node)
+		j.visit(q.right, node)
+	} else {
+		j.reverseQuery(q, node)
+
+		near, far := node.Left, node.Right
+		if near == nil || (far != nil && q.node.box.squaredDistanceTo(&far.box) < q.node.box.squaredDistanceTo(&near.box)) {
+			near, far = far, near
+		}
+
+		j.visit(q, near)
+		j.visit(q, far)
+	}
+
+	q.updateBound()
+}
+
+// point queries for all keys of the subtree q
+func (j *nearestJoin) pointQueries(q *joinQuery, node *Node) {
+
+	if q == nil || q.node.box.squaredDistanceTo(&node.box) > q.bound {
+		return
+	}
+
+	j.pointQuery(q, node)
+	j.pointQueries(q.left, node)
+	j.pointQueries(q.right, node)
+
+	q.updateBound()
+}
+
+// searches the subtree node for a nearer neighbour of the key of q
+func (j *nearestJoin) pointQuery(q *joinQuery, node *Node) {
+
+	if node.box.minSquaredDistance(&q.node.Key) > q.nearest.distance {
+		return
+	}
+
+	s := j.search
+	s.key = &q.node.Key
+	s.neighbours.reset(1)
+	s.neighbours.offer(q.nearest.value, q.nearest.distance)
+
+	j.right.nearestNeighbour(s, node)
+
+	q.nearest = s.neighbours.items[0]
+}
+
+// offers the key of node to all keys of the subtree q
+func (j *nearestJoin) reverseQuery(q *joinQuery, node *Node) {
+
+	if q == nil || q.node.box.minSquaredDistance(&node.Key) > q.bound {
+		return
+	}
+
+	if _, distance := q.node.Key.GetSquaredDistance(&node.Key); distance < q.nearest.distance {
+		q.nearest = neighbour{value: node.GetValue(), distance: distance}
+	}
+
+	j.reverseQuery(q.left, node)
+	j.reverseQuery(q.right, node)
+
+	q.updateBound()
+}
+
+// reports whether the join of the subtrees a and b splits a, the one
+// with the larger box, rather than b. Leaves are never split.
+func splitsLeft(a *Node, b *Node) bool {
+
+	if a.IsLeaf() || b.IsLeaf() {
+		return b.IsLeaf()
+	}
+
+	return a.box.squaredDiameter() >= b.box.squaredDiameter()
+}
+
+func (b *BoundingBox) squaredDiameter() float64 {
+
+	sum := 0.0
+	for i := range b.Min {
+		sum += squaredDelta(b.Min[i], b.Max[i])
+	}
+
+	return sum
+}
+
+// returns the smallest squared distance between points of the boxes
+func (b *BoundingBox) squaredDistanceTo(other *BoundingBox) float64 {
+
+	sum := 0.0
+
+	for i := range b.Min {
+		if b.Max[i] < other.Min[i] {
+			sum += squaredDelta(b.Max[i], other.Min[i])
+		} else if other.Max[i] < b.Min[i] {
+			sum += squaredDelta(other.Max[i], b.Min[i])
+		}
+	}
+
+	return sum
+}
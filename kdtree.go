@@ -2,16 +2,21 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"math"
 )
 
 type Value = [10]byte
 
 type KDTree struct {
-	kSize   int
-	maxSize uint64
-	size    uint64 // current size in bytes
-	root    *Node
+	kSize    int
+	maxSize  uint64
+	size     uint64 // current size in bytes
+	root     *Node
+	strategy SplitStrategy
+	stats    keyStatistics
+	workers  int   // goroutines per query, see SetWorkers
+	depths   []int // nodes per depth, the root is at 0
 }
 
 func (t *KDTree) Put(key *Point, value Value) error {
@@ -26,9 +31,19 @@ func (t *KDTree) Put(key *Point, value Value) error {
 		return err
 	}
 
+	t.stats.add(key)
+
+	// only needed to choose the axis by spread or variance
+	var nodeCell *cell
+	if t.strategy != RoundRobin {
+		nodeCell = newCell(t.kSize)
+	}
+
 	if t.root == nil {
+		node.axis = t.chooseAxis(0, nodeCell)
 		t.root = node
 		t.size += node.GetByteSize()
+		t.addDepth(0)
 		return nil
 	}
 
@@ -36,21 +51,31 @@ func (t *KDTree) Put(key *Point, value Value) error {
 
 	for depth := 0; ; depth++ {
 
-		keyIndex := depth % t.kSize
+		currentNode.count++
+		currentNode.extendBox(key)
+		split := currentNode.SplitValue()
+
+		if split <= node.KeyValueAt(currentNode.axis) {
+			nodeCell.toRight(currentNode.axis, split)
 
-		if currentNode.KeyValueAt(keyIndex) < node.KeyValueAt(keyIndex) {
 			if currentNode.Right == nil {
+				node.axis = t.chooseAxis(depth+1, nodeCell)
 				currentNode.Right = node
 				t.size += node.GetByteSize()
+				t.addDepth(depth + 1)
 				return nil
 			}
 
 			currentNode = currentNode.Right
 
 		} else {
+			nodeCell.toLeft(currentNode.axis, split)
+
 			if currentNode.Left == nil {
+				node.axis = t.chooseAxis(depth+1, nodeCell)
 				currentNode.Left = node
 				t.size += node.GetByteSize()
+				t.addDepth(depth + 1)
 				return nil
 			}
 
@@ -63,10 +88,13 @@ func (t *KDTree) Put(key *Point, value Value) error {
 func (t *KDTree) Get(key *Point) ([]Value, error) {
 
 	if key.IsPartial() {
-		return t.partialSearchQuery(0, key, t.root), nil
+		if t.workers > 1 {
+			return nodeValues(t.parallelPartialSearchQuery(key, t.root, 0, make(chan struct{}, t.workers-1))), nil
+		}
+		return nodeValues(t.partialSearchQuery(key, t.root, 1, nil)), nil
 	}
 
-	_, _, node := t.searchQuery(key)
+	_, node := t.searchQuery(key, nil)
 	if node == nil {
 		return make([]Value, 0, 0), errors.New("Couldn't find key")
 	}
@@ -76,310 +104,577 @@ func (t *KDTree) Get(key *Point) ([]Value, error) {
 
 func (t *KDTree) Delete(key *Point) error {
 
-	depth, parent, node := t.searchQuery(key)
-	return t.deleteNode(parent, node, depth)
+	_, err := t.DeleteReturning(key)
+	return err
 }
 
-func (t *KDTree) deleteNode(parent *Node, node *Node, depth int) error {
+// removes the node stored under key and returns its value
+func (t *KDTree) DeleteReturning(key *Point) (Value, error) {
+
+	if key == nil || key.GetSize() != t.kSize || key.IsPartial() {
+		return *new(Value), errors.New("Wrong key!")
+	}
+
+	if t.root == nil {
+		return *new(Value), errors.New("node to delete not found")
+	}
+
+	parent, node := t.searchQuery(key, nil)
 
 	if node == nil {
-		return errors.New("node to delete not found")
+		return *new(Value), errors.New("node to delete not found")
 	}
 
-	if node.IsLeaf() {
-		if parent.IsLeftChild(node) {
-			parent.Left = nil
-		} else {
-			parent.Right = nil
-		}
+	// the node may take over the key and value of its replacement
+	value := node.GetValue()
+
+	return value, t.deleteNode(parent, node)
+}
+
+// removes every node a partial Get with the same key would return
+// and returns the number of removed nodes
+func (t *KDTree) DeleteMatching(partialKey *Point) (int, error) {
 
-	} else if node.Right != nil {
+	if partialKey == nil || partialKey.GetSize() != t.kSize {
+		return 0, errors.New("wrong key size")
+	}
 
-		keyIndex := depth % t.kSize
-		depth, _, minNode := t.searchMinimum(node.Right, keyIndex, 0)
-		_, minParent, _ := t.searchQuery(&minNode.Key)
+	return t.deleteNodes(t.partialSearchQuery(partialKey, t.root, 1, nil))
+}
 
-		if minNode != nil {
+// removes every node a Scan with the same bounds would return
+// and returns the number of removed nodes
+func (t *KDTree) DeleteRange(from *Point, to *Point) (int, error) {
 
-			t.deleteNode(minParent, minNode, depth)
+	r, err := NewRange(t.kSize, from, to)
+	if err != nil {
+		return 0, err
+	}
 
-			// put min at top
+	return t.deleteNodes(t.scanQuery(t.root, r, 1, nil))
+}
 
-			minNode.Right = node.Right
-			minNode.Left = node.Left
-			if t.root == node {
-				t.root = minNode
-			} else if parent.IsLeftChild(node) {
-				parent.Left = minNode
-			} else {
-				parent.Right = minNode
-			}
+func (t *KDTree) deleteNodes(nodes []*Node) (int, error) {
+
+	// the keys are copied first since deleting
+	// relinks the nodes which are still to visit
+	keys := make([]Point, len(nodes))
+	for i, n := range nodes {
+		keys[i] = n.Key
+	}
+
+	for i := range keys {
+		if err := t.Delete(&keys[i]); err != nil {
+			return i, err
 		}
+	}
+
+	return len(keys), nil
+}
 
-	} else if node.Left != nil {
+// removes node from the tree without recursion. A node with children
+// is not unlinked, instead it takes over key and value of the node with
+// the minimal coordinate on its cutting axis in the right subtree, which
+// then is deleted in turn until a leaf is reached. Without a right
+// subtree the left one is moved to the right first.
+func (t *KDTree) deleteNode(parent *Node, node *Node) error {
 
-		keyIndex := depth % t.kSize
-		//TODO change to search maximum
-		depth, _, maxNode := t.searchMaximum(node.Left, keyIndex, 0)
-		_, maxParent, _ := t.searchQuery(&maxNode.Key)
+	if node == nil {
+		return errors.New("node to delete not found")
+	}
 
-		if maxNode != nil {
+	t.size -= node.GetByteSize()
 
-			t.deleteNode(maxParent, maxNode, depth)
+	for !node.IsLeaf() {
 
-			// put min at top
-			maxNode.Right = node.Right
-			maxNode.Left = node.Left
-			if t.root == node {
-				t.root = maxNode
-			} else if parent.IsLeftChild(node) {
-				parent.Left = maxNode
-			} else {
-				parent.Right = maxNode
-			}
+		if node.Right == nil {
+			node.Right = node.Left
+			node.Left = nil
 		}
+
+		// the node keeps its axis, it is given by its position
+		minParent, minNode := searchMinimum(node, node.Right, node.axis)
+
+		node.Key = minNode.Key
+		node.value = minNode.value
+
+		parent, node = minParent, minNode
+	}
+
+	ancestors := t.ancestors(node)
+	t.removeDepth(len(ancestors))
+
+	if parent == nil {
+		t.root = nil
+	} else if parent.IsLeftChild(node) {
+		parent.Left = nil
+	} else {
+		parent.Right = nil
 	}
 
-	t.size += node.GetByteSize()
+	// every node whose subtree lost a key or whose key
+	// was replaced lies on the path to the unlinked leaf
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		ancestors[i].count--
+		ancestors[i].updateBox()
+	}
 
 	return nil
 }
 
-func (t *KDTree) searchMinimum(n *Node, keyIndex int, depthParam int) (int, *Node, *Node) {
-	var (
-		parentLeft  *Node = nil
-		parentRight *Node = nil
-		nodeLeft    *Node = nil
-		nodeRight   *Node = nil
-		depthLeft   int   = 0
-		depthRight  int   = 0
-	)
+// returns the path from the root down to the parent of node. It is given
+// by the key of node, since the tree invariant holds during deletion.
+func (t *KDTree) ancestors(node *Node) []*Node {
 
-	if n.Left != nil {
-		depthLeft, parentLeft, nodeLeft = t.searchMinimum(n.Left, keyIndex, depthParam+1)
+	path := make([]*Node, 0, 32)
+	current := t.root
+
+	for current != node {
+		path = append(path, current)
+
+		if current.SplitValue() <= node.KeyValueAt(current.axis) {
+			current = current.Right
+		} else {
+			current = current.Left
+		}
 	}
 
-	if n.Right != nil {
-		depthRight, parentRight, nodeRight = t.searchMinimum(n.Right, keyIndex, depthParam+1)
+	return path
+}
+
+type searchFrame struct {
+	parent *Node
+	node   *Node
+}
+
+// returns the node with the minimal coordinate at
+// keyIndex in the subtree n and its parent
+func searchMinimum(parent *Node, n *Node, keyIndex int) (*Node, *Node) {
+
+	minimum := searchFrame{parent: parent, node: n}
+	stack := []searchFrame{minimum}
+
+	for len(stack) > 0 {
+
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if frame.node.SmallerThan(minimum.node, keyIndex) {
+			minimum = frame
+		}
+
+		// the right subtree cannot contain
+		// smaller values on its own cutting axis
+		if frame.node.Left != nil {
+			stack = append(stack, searchFrame{parent: frame.node, node: frame.node.Left})
+		}
+
+		if frame.node.Right != nil && frame.node.axis != keyIndex {
+			stack = append(stack, searchFrame{parent: frame.node, node: frame.node.Right})
+		}
 	}
 
-	if nodeRight == nil && nodeLeft == nil {
-		return depthParam, nil, n
+	return minimum.parent, minimum.node
+}
+
+// checks that every node satisfies the k-d tree invariant, i.e. all keys
+// in its left subtree are smaller and all keys in its right subtree are
+// greater or equal on its cutting axis, and that the size and the
+// subtree counters and the nodes per depth are consistent
+func (t *KDTree) Validate() error {
+
+	type boundedFrame struct {
+		depth int
+		node  *Node
+		cell  *cell
 	}
 
-	if nodeRight == nil {
-		if nodeLeft.SmallerThan(n, keyIndex) {
-			return depthLeft, parentLeft, nodeLeft
-		} else {
-			return depthParam, nil, n
+	var size uint64 = 4 * 8
+
+	if t.root == nil {
+		if t.size != size {
+			return fmt.Errorf("size of empty tree is %d instead of %d", t.size, size)
+		}
+		if len(t.depths) != 0 {
+			return fmt.Errorf("empty tree counts nodes at %d depths", len(t.depths))
 		}
+		return nil
 	}
 
-	if nodeLeft == nil {
-		if nodeRight.SmallerThan(n, keyIndex) {
-			return depthRight, parentRight, nodeRight
-		} else {
-			return depthParam, nil, n
+	depths := make([]int, 0, len(t.depths))
+
+	stack := []boundedFrame{{depth: 0, node: t.root, cell: newCell(t.kSize)}}
+
+	for len(stack) > 0 {
+
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node := frame.node
+		size += node.GetByteSize()
+
+		if frame.depth == len(depths) {
+			depths = append(depths, 0)
+		}
+		depths[frame.depth]++
+
+		if node.Key.GetSize() != t.kSize || node.Key.IsPartial() {
+			return fmt.Errorf("node at depth %d has an invalid key", frame.depth)
+		}
+
+		if node.axis < 0 || node.axis >= t.kSize {
+			return fmt.Errorf("node at depth %d has an invalid axis %d", frame.depth, node.axis)
+		}
+
+		if !frame.cell.contains(&node.Key) {
+			return fmt.Errorf("node at depth %d violates the bounds of its ancestors", frame.depth)
+		}
+
+		if node.count != 1+node.Left.GetCount()+node.Right.GetCount() {
+			return fmt.Errorf("node at depth %d counts %d nodes in its subtree", frame.depth, node.count)
+		}
+
+		box := BoundingBox{Min: make([]uint64, t.kSize), Max: make([]uint64, t.kSize)}
+		node.computeBox(&box)
+		for i := range box.Min {
+			if box.Min[i] != node.box.Min[i] || box.Max[i] != node.box.Max[i] {
+				return fmt.Errorf("node at depth %d has a wrong box in dimension %d", frame.depth, i)
+			}
 		}
+
+		split := node.SplitValue()
+
+		if node.Left != nil {
+			left := frame.cell.clone()
+			left.toLeft(node.axis, split)
+			stack = append(stack, boundedFrame{depth: frame.depth + 1, node: node.Left, cell: left})
+		}
+
+		if node.Right != nil {
+			right := frame.cell.clone()
+			right.toRight(node.axis, split)
+			stack = append(stack, boundedFrame{depth: frame.depth + 1, node: node.Right, cell: right})
+		}
+	}
+
+	if size != t.size {
+		return fmt.Errorf("tree size is %d but nodes sum up to %d", t.size, size)
 	}
 
-	minNode := getMin(nodeLeft, nodeRight, n, keyIndex)
-	switch minNode {
-	case n:
-		return depthParam, nil, n
-	case nodeLeft:
-		return depthLeft, nil, nodeLeft
-	case nodeRight:
-		return depthRight, nil, nodeRight
+	if len(depths) != len(t.depths) {
+		return fmt.Errorf("tree counts nodes at %d depths but has %d", len(t.depths), len(depths))
+	}
+	for d := range depths {
+		if depths[d] != t.depths[d] {
+			return fmt.Errorf("tree counts %d nodes at depth %d but has %d", t.depths[d], d, depths[d])
+		}
 	}
-	return 0, nil, nil
+
+	return nil
 }
 
-func getMin(node1 *Node, node2 *Node, node3 *Node, keyIndex int) *Node {
-	if node1.SmallerThan(node2, keyIndex) && node1.SmallerThan(node3, keyIndex) {
-		return node1
+func (t *KDTree) Scan(from *Point, to *Point) ([]Value, error) {
+
+	r, err := NewRange(t.kSize, from, to)
+	if err != nil {
+		return make([]Value, 0), err
 	}
-	if node2.SmallerThan(node1, keyIndex) && node2.SmallerThan(node3, keyIndex) {
-		return node2
+
+	return t.ScanRange(r)
+}
+
+// like Scan, but the range may have exclusive bounds
+func (t *KDTree) ScanRange(r *Range) ([]Value, error) {
+
+	if r == nil || r.GetSize() != t.kSize {
+		return make([]Value, 0), errors.New("wrong range size")
 	}
-	if node3.SmallerThan(node1, keyIndex) && node3.SmallerThan(node2, keyIndex) {
-		return node3
+
+	if t.workers > 1 {
+		return nodeValues(t.parallelScanQuery(t.root, r, 0, make(chan struct{}, t.workers-1))), nil
 	}
-	return nil
+
+	result := t.scanQuery(t.root, r, 1, nil)
+
+	return nodeValues(result), nil
 }
 
-func (t *KDTree) searchMaximum(n *Node, keyIndex int, depthParam int) (int, *Node, *Node) {
-	//TODO also keep track of the parent
-	var (
-		parentLeft  *Node = nil
-		parentRight *Node = nil
-		nodeLeft    *Node = nil
-		nodeRight   *Node = nil
-		depthLeft   int   = 0
-		depthRight  int   = 0
-	)
+// returns the nodes of the subtree node at depth within r,
+// the work is counted in trace, which may be nil
+func (t *KDTree) scanQuery(node *Node, r *Range, depth int, trace *QueryTrace) []*Node {
+
+	nodes := make([]*Node, 0, 10)
 
-	if n.Left != nil {
-		depthLeft, parentLeft, nodeLeft = t.searchMaximum(n.Left, keyIndex, depthParam+1)
+	if node == nil {
+		return nodes
 	}
 
-	if n.Right != nil {
-		depthRight, parentRight, nodeRight = t.searchMaximum(n.Right, keyIndex, depthParam+1)
+	if !node.box.intersectsRange(r) {
+		trace.prune(node)
+		return nodes
 	}
 
-	if nodeRight == nil && nodeLeft == nil {
-		return depthParam, nil, n
+	if node.box.isWithinRange(r) {
+		return appendSubtree(nodes, node, depth, trace)
 	}
 
-	if nodeRight == nil {
-		return depthLeft, parentLeft, nodeLeft
+	trace.visit(depth)
+
+	visitLeft, visitRight := scanBranches(node, r)
+
+	if visitLeft {
+		result := t.scanQuery(node.Left, r, depth+1, trace)
+		nodes = append(nodes, result...)
+	} else {
+		trace.prune(node.Left)
 	}
 
-	if nodeLeft == nil {
-		return depthRight, parentRight, nodeRight
+	if visitRight {
+		result := t.scanQuery(node.Right, r, depth+1, trace)
+		nodes = append(nodes, result...)
+	} else {
+		trace.prune(node.Right)
 	}
 
-	if nodeLeft.KeyValueAt(keyIndex) > nodeRight.KeyValueAt(keyIndex) {
-		return depthLeft, parentLeft, nodeLeft
+	if node.Key.IsWithin(r) {
+		nodes = append(nodes, node)
 	}
 
-	return depthRight, parentRight, nodeRight
+	return nodes
 }
 
-func (t *KDTree) Scan(from *Point, to *Point) ([]Value, error) {
+// appends all nodes of the subtree node in the order of scanQuery
+func appendSubtree(nodes []*Node, node *Node, depth int, trace *QueryTrace) []*Node {
 
-	if (from != nil && from.GetSize() != t.kSize) || (to != nil && to.GetSize() != t.kSize) {
-		return make([]Value, 0), errors.New("wrong key size")
+	if node == nil {
+		return nodes
 	}
 
-	result := t.scanQuery(t.root, from, to, 0)
+	trace.visit(depth)
 
-	return result, nil
+	nodes = appendSubtree(nodes, node.Left, depth+1, trace)
+	nodes = appendSubtree(nodes, node.Right, depth+1, trace)
+
+	return append(nodes, node)
 }
 
-func (t *KDTree) scanQuery(node *Node, from *Point, to *Point, depth int) []Value {
+// returns whether the left and the right subtree
+// of node may hold keys within r
+func scanBranches(node *Node, r *Range) (bool, bool) {
 
-	values := make([]Value, 0, 10)
+	// left subtree holds smaller keys,
+	// right subtree greater or equal ones
+	return r.reachesBelow(node.axis, node.SplitValue()), r.reachesFrom(node.axis, node.SplitValue())
+}
 
-	if node == nil {
-		return values
-	}
+func (t *KDTree) GetNN(key *Point) (Value, error) {
+
+	return t.GetNNWithOptions(key, nil)
+}
 
-	keyIndex := depth % t.kSize
-	nodeKey := node.KeyValueAt(keyIndex)
+// NNOptions trade accuracy of the nearest neighbour search for latency.
+// The zero value, like passing nil, requests an exact search.
+type NNOptions struct {
+	// a subtree is skipped unless it may contain a point which is closer
+	// than the current best by a factor of 1 + Epsilon, the returned
+	// neighbour therefore is at most (1 + Epsilon) times farther away
+	// from the key than the exact nearest neighbour
+	Epsilon float64
+
+	// the search stops after visiting this many nodes, 0 means no limit.
+	// The path down to the cell of the key is visited first, so already
+	// small limits give reasonable results.
+	MaxVisits int
+
+	// computes the distance to every key instead of searching the tree,
+	// split over the workers of the tree. In high dimensions the search
+	// visits most nodes anyway and this is faster. The result is exact,
+	// Epsilon and MaxVisits are ignored.
+	BruteForce bool
+
+	// only keys matching Filter are returned, its None coordinates match
+	// any value like those of a partial Get. Subtrees which cannot hold
+	// a matching key are skipped.
+	Filter *Point
+
+	// only entries Accept returns true for are returned, the search goes
+	// on past rejected ones. Accept may be called concurrently.
+	Accept func(key *Point, value Value) bool
+}
 
-	var fromK uint64 = 0
-	var toK uint64 = math.MaxUint64
+func (o *NNOptions) check(kSize int) error {
 
-	if from != nil {
-		_, tmpK := from.GetKeyAt(keyIndex)
-		if tmpK.IsSome {
-			fromK = tmpK.Value
-		}
+	if o.Epsilon < 0 || o.MaxVisits < 0 {
+		return errors.New("Epsilon and MaxVisits cannot be negative")
 	}
 
-	if to != nil {
-		_, tmpK := to.GetKeyAt(keyIndex)
-		if tmpK.IsSome {
-			toK = tmpK.Value
-		}
+	if math.IsNaN(o.Epsilon) || math.IsInf(o.Epsilon, 1) {
+		return errors.New("Epsilon has to be finite")
 	}
 
-	branchesToVisit := 0
-
-	if nodeKey >= fromK {
-		result := t.scanQuery(node.Left, from, to, depth+1)
-		values = append(values, result...)
-		branchesToVisit++
+	if o.Filter != nil && o.Filter.GetSize() != kSize {
+		return errors.New("wrong filter size")
 	}
 
-	if nodeKey <= toK {
-		result := t.scanQuery(node.Right, from, to, depth+1)
-		values = append(values, result...)
-		branchesToVisit++
-	}
+	return nil
+}
+
+// reports whether an entry may be returned
+func (o *NNOptions) accepts(key *Point, value Value) bool {
+	return (o.Filter == nil || key.IsPartiallyEqual(o.Filter)) &&
+		(o.Accept == nil || o.Accept(key, value))
+}
 
+// reports which subtrees of a split may hold keys matching the filter,
+// left subtree holds smaller keys, right subtree greater or equal ones
+func (o *NNOptions) filterBranches(axis int, split uint64) (bool, bool) {
 
-	if branchesToVisit == 2 && node.Key.IsWithin(from, to) {
-		values = append(values, node.GetValue())
+	if o.Filter == nil || !o.Filter.coords[axis].IsSome {
+		return true, true
 	}
 
-	return values
+	v := o.Filter.coords[axis].Value
+	return v < split, v >= split
 }
 
-func (t *KDTree) GetNN(key *Point) (Value, error) {
+// state of a nearest neighbour search
+type nnSearch struct {
+	key        *Point
+	options    NNOptions
+	visits     int
+	neighbours *neighbourHeap
+	depth      int         // of the parent of the current node
+	trace      *QueryTrace // nil unless traced
+}
 
-	if t.root == nil {
-		return *new(Value), errors.New("Tree is empty!")
+func (t *KDTree) GetNNWithOptions(key *Point, options *NNOptions) (Value, error) {
+
+	values, err := t.GetKNNWithOptions(key, 1, options)
+
+	if err != nil {
+		return *new(Value), err
 	}
 
-	if key == nil || key.GetSize() != int(t.kSize) {
-		return *new(Value), errors.New("Wrong or nil key!")
+	if len(values) == 0 {
+		return *new(Value), errors.New("no key passes the filter")
 	}
 
-	nearestNode := t.nearestNeighbour(t.root, key, 0)
+	return values[0], nil
+}
+
+// returns the values of the k nearest neighbours of key ordered by
+// ascending distance, fewer if the tree holds less than k nodes.
+// None coordinates of key are ignored, both in the distance and
+// when pruning, so the search runs in the subspace of the given ones.
+// With a Filter or Accept in the options fewer values may be returned.
+func (t *KDTree) GetKNN(key *Point, k int) ([]Value, error) {
 
-	return nearestNode.GetValue(), nil
+	return t.GetKNNWithOptions(key, k, nil)
 }
 
-func (t *KDTree) nearestNeighbour(node *Node, key *Point, depth int) *Node {
+func (t *KDTree) GetKNNWithOptions(key *Point, k int, options *NNOptions) ([]Value, error) {
 
-	if node == nil {
-		return nil
+	if t.root == nil {
+		return make([]Value, 0), errors.New("Tree is empty!")
 	}
 
-	keyIndex := depth % t.kSize
+	if key == nil || key.GetSize() != int(t.kSize) {
+		return make([]Value, 0), errors.New("Wrong or nil key!")
+	}
 
-	nodeKeyValue := node.KeyValueAt(keyIndex)
-	_, kv := key.GetKeyAt(keyIndex)
+	// None coordinates are ignored, but one is needed
+	if key.IsEmpty() {
+		return make([]Value, 0), errors.New("key has no coordinates")
+	}
 
-	var nextBranch *Node
-	var alternativeBranch *Node
+	if k < 1 {
+		return make([]Value, 0), errors.New("k has to be at least 1")
+	}
 
-	if kv.Value > nodeKeyValue {
-		nextBranch = node.Right
-		alternativeBranch = node.Left
-	} else {
-		nextBranch = node.Left
-		alternativeBranch = node.Right
+	if options == nil {
+		options = &NNOptions{}
 	}
 
-	tmp := t.nearestNeighbour(nextBranch, key, depth+1)
-	closest := findClosest(key, tmp, node)
+	if err := options.check(t.kSize); err != nil {
+		return make([]Value, 0), err
+	}
 
-	if closest == nil {
-		return nil
+	if options.BruteForce {
+		return t.bruteForceKNN(key, k, options), nil
 	}
 
-	_, distanceToBest := key.GetDistance(&closest.Key)
+	search := &nnSearch{key: key, options: *options, neighbours: newNeighbourHeap(k)}
+	t.nearestNeighbour(search, t.root)
+
+	return search.neighbours.sorted(), nil
+}
 
-	dist := math.Abs(float64(nodeKeyValue) - float64(kv.Value))
+func (t *KDTree) nearestNeighbour(s *nnSearch, node *Node) {
 
-	if distanceToBest >= dist {
-		tmp = t.nearestNeighbour(alternativeBranch, key, depth+1)
-		closest = findClosest(key, tmp, closest)
+	if node == nil || s.isExhausted() {
+		return
 	}
 
-	return closest
-}
+	if s.prunes(&node.box) {
+		s.trace.prune(node)
+		return
+	}
 
-func findClosest(key *Point, node1 *Node, node2 *Node) *Node {
+	s.visits++
+	s.trace.visit(s.depth + 1)
 
-	dist1 := math.MaxFloat64
-	dist2 := math.MaxFloat64
+	if s.options.accepts(&node.Key, node.GetValue()) {
+		_, distance := s.key.GetSquaredDistance(&node.Key)
+		s.neighbours.offer(node.GetValue(), distance)
+		s.trace.computeDistance()
+	}
+
+	nodeKeyValue := node.SplitValue()
+	_, kv := s.key.GetKeyAt(node.axis)
 
-	if node1 != nil {
-		_, dist1 = key.GetDistance(&node1.Key)
+	// subtrees without keys matching the filter are skipped
+	left, right := node.Left, node.Right
+	if visitLeft, visitRight := s.options.filterBranches(node.axis, nodeKeyValue); !visitLeft {
+		s.trace.prune(left)
+		left = nil
+	} else if !visitRight {
+		s.trace.prune(right)
+		right = nil
 	}
-	if node2 != nil {
-		_, dist2 = key.GetDistance(&node2.Key)
+
+	var nextBranch *Node
+	var alternativeBranch *Node
+
+	if kv.Value >= nodeKeyValue {
+		nextBranch = right
+		alternativeBranch = left
+	} else {
+		nextBranch = left
+		alternativeBranch = right
 	}
 
-	if dist1 < dist2 {
-		return node1
+	// the alternative branch is skipped on entry
+	// if its box lies too far away by then
+	s.depth++
+	t.nearestNeighbour(s, nextBranch)
+	t.nearestNeighbour(s, alternativeBranch)
+	s.depth--
+}
+
+func (s *nnSearch) isExhausted() bool {
+	return s.options.MaxVisits > 0 && s.visits >= s.options.MaxVisits
+}
+
+// reports whether no key within box can be closer than the current
+// neighbours by a factor of 1 + Epsilon. None coordinates of the key
+// do not restrict the distance. Nothing is pruned before k keys are found.
+func (s *nnSearch) prunes(box *BoundingBox) bool {
+	if !s.neighbours.isFull() {
+		return false
 	}
 
-	return node2
+	scale := 1 + s.options.Epsilon
+	return box.minSquaredDistance(s.key)*scale*scale > s.neighbours.bound()
 }
 
 func (t *KDTree) Upsert(key *Point, value Value) error {
@@ -388,7 +683,7 @@ func (t *KDTree) Upsert(key *Point, value Value) error {
 		return errors.New("Wrong key!")
 	}
 
-	_, _, node := t.searchQuery(key)
+	_, node := t.searchQuery(key, nil)
 
 	if node == nil {
 		return errors.New("Couldnt find node to upsert")
@@ -400,40 +695,66 @@ func (t *KDTree) Upsert(key *Point, value Value) error {
 }
 
 func NewKDTree(keySize int, maxSize uint64) (*KDTree, error) {
+
+	return NewKDTreeWithStrategy(keySize, maxSize, RoundRobin)
+}
+
+func NewKDTreeWithStrategy(keySize int, maxSize uint64, strategy SplitStrategy) (*KDTree, error) {
 	if keySize < 1 {
 		return nil, errors.New("key size has to be at least 1")
 	}
 
-	return &KDTree{kSize: keySize, maxSize: maxSize, size: 4 * 8, root: nil}, nil
+	if strategy < RoundRobin || strategy > MaxVariance {
+		return nil, errors.New("unknown split strategy")
+	}
+
+	return &KDTree{
+		kSize:    keySize,
+		maxSize:  maxSize,
+		size:     4 * 8,
+		root:     nil,
+		strategy: strategy,
+		stats:    newKeyStatistics(keySize),
+		workers:  1,
+	}, nil
 }
 
-// returns found Node and parent of found Node
-func (t *KDTree) searchQuery(key *Point) (int, *Node, *Node) {
+// returns found Node and parent of found Node,
+// the work is counted in trace, which may be nil
+func (t *KDTree) searchQuery(key *Point, trace *QueryTrace) (*Node, *Node) {
 
 	var parentNode *Node = nil
 	currentNode := t.root
 
-	for depth := 0; ; depth++ {
+	if currentNode == nil {
+		return nil, nil
+	}
+
+	for depth := 1; ; depth++ {
+
+		trace.visit(depth)
 
 		if currentNode.Key.IsEqual(key) {
-			return depth, parentNode, currentNode
+			return parentNode, currentNode
 		}
 
-		keyIndex := depth % t.kSize
+		_, kv := key.GetKeyAt(currentNode.axis)
 
-		_, kv := key.GetKeyAt(keyIndex)
+		if currentNode.SplitValue() <= kv.Value {
+			trace.prune(currentNode.Left)
 
-		if currentNode.KeyValueAt(keyIndex) < kv.Value {
 			if currentNode.Right == nil {
-				return depth, currentNode, nil
+				return currentNode, nil
 			}
 
 			parentNode = currentNode
 			currentNode = currentNode.Right
 
 		} else {
+			trace.prune(currentNode.Right)
+
 			if currentNode.Left == nil {
-				return depth, currentNode, nil
+				return currentNode, nil
 			}
 
 			parentNode = currentNode
@@ -442,56 +763,57 @@ func (t *KDTree) searchQuery(key *Point) (int, *Node, *Node) {
 	}
 }
 
-func (t *KDTree) partialSearchQuery(depth int, key *Point, node *Node) []Value {
+// returns the nodes of the subtree node at depth matching key,
+// the work is counted in trace, which may be nil
+func (t *KDTree) partialSearchQuery(key *Point, node *Node, depth int, trace *QueryTrace) []*Node {
 
 	// reserve size 10
-	values := make([]Value, 0, 10)
+	nodes := make([]*Node, 0, 10)
 
 	if node == nil {
-		return values
+		return nodes
 	}
 
+	trace.visit(depth)
+
 	if node.Key.IsPartiallyEqual(key) {
-		values = append(values, node.GetValue())
+		nodes = append(nodes, node)
 	}
 
-	keyIndex := depth % t.kSize
-
-	_, kv := key.GetKeyAt(keyIndex)
+	_, kv := key.GetKeyAt(node.axis)
 
-	nodeKeyValue := node.KeyValueAt(keyIndex)
+	nodeKeyValue := node.SplitValue()
 
-	if !kv.IsSome || nodeKeyValue >= kv.Value {
-		resultLeft := t.partialSearchQuery(depth+1, key, node.Left)
-		values = append(values, resultLeft...)
+	if !kv.IsSome || nodeKeyValue > kv.Value {
+		resultLeft := t.partialSearchQuery(key, node.Left, depth+1, trace)
+		nodes = append(nodes, resultLeft...)
+	} else {
+		trace.prune(node.Left)
 	}
 
-	if !kv.IsSome || nodeKeyValue < kv.Value {
-		resultRight := t.partialSearchQuery(depth+1, key, node.Right)
-		values = append(values, resultRight...)
+	if !kv.IsSome || nodeKeyValue <= kv.Value {
+		resultRight := t.partialSearchQuery(key, node.Right, depth+1, trace)
+		nodes = append(nodes, resultRight...)
+	} else {
+		trace.prune(node.Right)
 	}
 
-	return values
-}
-
-func (t *KDTree) GetNodesCount() int {
-
-	return countSubTreesNodes(t.root) + 1
+	return nodes
 }
 
-func countSubTreesNodes(n *Node) int {
+func nodeValues(nodes []*Node) []Value {
 
-	count := 0
+	values := make([]Value, len(nodes))
 
-	if n.Left != nil {
-		count++
-		count += countSubTreesNodes(n.Left)
+	for i, n := range nodes {
+		values[i] = n.GetValue()
 	}
 
-	if n.Right != nil {
-		count++
-		count += countSubTreesNodes(n.Right)
-	}
+	return values
+}
+
+// 0 for an empty tree
+func (t *KDTree) GetNodesCount() int {
 
-	return count
+	return t.root.GetCount()
 }
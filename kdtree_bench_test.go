@@ -0,0 +1,589 @@
+/*
+*
+kdtree_bench_test.go
+Benchmarks for the KDTree operations
+Run with: go test -run '^$' -bench . -benchmem
+*/
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var (
+	benchDimensions = []int{3, 10, 100}
+	benchSizes      = []int{1000, 10000, 100000}
+)
+
+// benchWorkload is the baseline workload of all benchmarks. It is built
+// on createValues, so every coordinate is drawn uniformly from [0, 2^32)
+// and every value is a random 10 byte string. The random source is seeded
+// with the dimensions and the size, which makes the workload identical
+// across runs and therefore comparable with benchstat.
+//
+// stored holds the pairs put into the tree, extra holds pairs of the same
+// distribution which are not stored and serve as new keys and NN queries.
+type benchWorkload struct {
+	dimensions int
+	stored     []KeyValuePair
+	extra      []KeyValuePair
+	tree       *KDTree
+	forest     *KDForest     // built on first use
+	bucket     *BucketKDTree // built on first use
+}
+
+var benchWorkloads = map[string]*benchWorkload{}
+
+func getBenchWorkload(b *testing.B, dimensions int, size int) *benchWorkload {
+	name := fmt.Sprintf("%d/%d", dimensions, size)
+
+	if w, ok := benchWorkloads[name]; ok {
+		return w
+	}
+
+	rand.Seed(int64(dimensions*1000003 + size))
+
+	_, _, stored := createValues(dimensions, size+1)
+	_, _, extra := createValues(dimensions, 1001)
+
+	w := &benchWorkload{dimensions: dimensions, stored: stored, extra: extra}
+	w.tree = w.newTree(b)
+
+	benchWorkloads[name] = w
+	return w
+}
+
+// builds a tree holding all stored pairs
+func (w *benchWorkload) newTree(b *testing.B) *KDTree {
+	tree, err := NewKDTree(w.dimensions, STORESIZE*100)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := range w.stored {
+		if err := tree.Put(&w.stored[i].key, w.stored[i].value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return tree
+}
+
+func (w *benchWorkload) getForest(b *testing.B) *KDForest {
+	if w.forest != nil {
+		return w.forest
+	}
+
+	forest, err := NewKDForest(w.dimensions, &KDForestOptions{Seed: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := range w.stored {
+		if err := forest.Put(&w.stored[i].key, w.stored[i].value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	w.forest = forest
+	return forest
+}
+
+func (w *benchWorkload) getBucketTree(b *testing.B) *BucketKDTree {
+	if w.bucket != nil {
+		return w.bucket
+	}
+
+	tree, err := NewBucketKDTree(w.dimensions, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := range w.stored {
+		if err := tree.Put(&w.stored[i].key, w.stored[i].value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	w.bucket = tree
+	return tree
+}
+
+// runs bench for every combination of dimensions and size
+func runBenchmarks(b *testing.B, bench func(b *testing.B, w *benchWorkload)) {
+	for _, dimensions := range benchDimensions {
+		for _, size := range benchSizes {
+			b.Run(fmt.Sprintf("dims=%d/size=%d", dimensions, size), func(b *testing.B) {
+				w := getBenchWorkload(b, dimensions, size)
+				b.ReportAllocs()
+				b.ResetTimer()
+				bench(b, w)
+			})
+		}
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		var tree *KDTree
+
+		// a fresh tree once all extra keys are in, so that every put
+		// goes into a tree of the same size whatever b.N is
+		for i := 0; i < b.N; i++ {
+			if i%len(w.extra) == 0 {
+				b.StopTimer()
+				tree = w.newTree(b)
+				b.StartTimer()
+			}
+
+			kv := &w.extra[i%len(w.extra)]
+			if err := tree.Put(&kv.key, kv.value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		for i := 0; i < b.N; i++ {
+			if _, err := w.tree.Get(&w.stored[i%len(w.stored)].key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPartialGet(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		for i := 0; i < b.N; i++ {
+			// only the first coordinate is set
+			key := make(Key, w.dimensions)
+			key[0] = w.stored[i%len(w.stored)].key.coords[0]
+			for d := 1; d < w.dimensions; d++ {
+				key[d] = None()
+			}
+			point := NewPoint(key)
+
+			if _, err := w.tree.Get(&point); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkUpsert(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		for i := 0; i < b.N; i++ {
+			kv := &w.stored[i%len(w.stored)]
+			if err := w.tree.Upsert(&kv.key, kv.value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDelete(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		b.StopTimer()
+		tree := w.newTree(b)
+		b.StartTimer()
+
+		// every deleted pair is put back, so that the size stays
+		// the same, the timing therefore includes one Put per op
+		for i := 0; i < b.N; i++ {
+			kv := &w.stored[i%len(w.stored)]
+			if err := tree.Delete(&kv.key); err != nil {
+				b.Fatal(err)
+			}
+			if err := tree.Put(&kv.key, kv.value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// worst case -> scan whole tree
+func BenchmarkScanAll(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		for i := 0; i < b.N; i++ {
+			if _, err := w.tree.Scan(nil, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// scans the box spanned by two stored keys on the
+// first axis, all other axes are unbounded
+func BenchmarkScanRange(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		for i := 0; i < b.N; i++ {
+			from, to := w.benchRange(i)
+			if _, err := w.tree.Scan(&from, &to); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// counts the same ranges as BenchmarkScanRange
+func BenchmarkCountRange(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		for i := 0; i < b.N; i++ {
+			from, to := w.benchRange(i)
+			if _, err := w.tree.Count(&from, &to); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// returns the i-th range of the range benchmarks
+func (w *benchWorkload) benchRange(i int) (Point, Point) {
+	from := make(Key, w.dimensions)
+	to := make(Key, w.dimensions)
+	for d := range from {
+		from[d], to[d] = None(), None()
+	}
+
+	lower := w.stored[i%len(w.stored)].key.coords[0].Value
+	upper := w.stored[(i+1)%len(w.stored)].key.coords[0].Value
+	if lower > upper {
+		lower, upper = upper, lower
+	}
+	from[0], to[0] = UInt64(lower), UInt64(upper)
+
+	return NewPoint(from), NewPoint(to)
+}
+
+func BenchmarkGetNN(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		for i := 0; i < b.N; i++ {
+			if _, err := w.tree.GetNN(&w.extra[i%len(w.extra)].key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkGetNNApproximate(b *testing.B) {
+	for _, options := range []NNOptions{{Epsilon: 0.5}, {Epsilon: 2}, {MaxVisits: 100}, {MaxVisits: 1000}} {
+		b.Run(fmt.Sprintf("eps=%g/visits=%d", options.Epsilon, options.MaxVisits), func(b *testing.B) {
+			runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+				for i := 0; i < b.N; i++ {
+					if _, err := w.tree.GetNNWithOptions(&w.extra[i%len(w.extra)].key, &options); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkForestGetNN(b *testing.B) {
+	for _, visits := range []int{100, 1000} {
+		options := NNOptions{MaxVisits: visits}
+		b.Run(fmt.Sprintf("visits=%d", visits), func(b *testing.B) {
+			runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+				b.StopTimer()
+				forest := w.getForest(b)
+				b.StartTimer()
+
+				for i := 0; i < b.N; i++ {
+					if _, err := forest.GetNNWithOptions(&w.extra[i%len(w.extra)].key, &options); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkBucketPut(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		var tree *BucketKDTree
+
+		// an empty tree once all stored keys are in, so that ns/op is
+		// the average put while building a tree of len(stored) keys
+		for i := 0; i < b.N; i++ {
+			if i%len(w.stored) == 0 {
+				b.StopTimer()
+				var err error
+				if tree, err = NewBucketKDTree(w.dimensions, 0); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+
+			kv := &w.stored[i%len(w.stored)]
+			if err := tree.Put(&kv.key, kv.value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkBucketScanAll(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		b.StopTimer()
+		tree := w.getBucketTree(b)
+		b.StartTimer()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := tree.Scan(nil, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkBucketGetNN(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		b.StopTimer()
+		tree := w.getBucketTree(b)
+		b.StartTimer()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := tree.GetNN(&w.extra[i%len(w.extra)].key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkArenaGetNN(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		b.StopTimer()
+		tree := newArenaTree(b, w)
+		b.StartTimer()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := tree.GetNN(&w.extra[i%len(w.extra)].key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkArenaScanAll(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		b.StopTimer()
+		tree := newArenaTree(b, w)
+		b.StartTimer()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := tree.Scan(nil, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func newArenaTree(b *testing.B, w *benchWorkload) *ArenaKDTree {
+	tree, err := NewArenaKDTree(w.dimensions)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := range w.stored {
+		if err := tree.Put(&w.stored[i].key, w.stored[i].value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return tree
+}
+
+// builds a whole tree per op and reports the live heap it occupies
+// as heap-B/tree, next to the allocations of the build itself
+func BenchmarkBuildMemory(b *testing.B) {
+	layouts := map[string]func(b *testing.B, w *benchWorkload) interface{}{
+		"pointer": newPointerTreeWithOwnKeys,
+		"arena":   func(b *testing.B, w *benchWorkload) interface{} { return newArenaTree(b, w) },
+	}
+
+	for _, layout := range []string{"pointer", "arena"} {
+		build := layouts[layout]
+		b.Run(layout, func(b *testing.B) {
+			runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+				var heap uint64
+				for i := 0; i < b.N; i++ {
+					before := liveHeap()
+					tree := build(b, w)
+					heap += liveHeap() - before
+					runtime.KeepAlive(tree)
+				}
+				b.ReportMetric(float64(heap)/float64(b.N), "heap-B/tree")
+			})
+		})
+	}
+}
+
+// measures a full garbage collection while a tree is alive,
+// the collector has to scan every node of the pointer layout
+func BenchmarkGCWithLiveTree(b *testing.B) {
+	layouts := map[string]func(b *testing.B, w *benchWorkload) interface{}{
+		"pointer": func(b *testing.B, w *benchWorkload) interface{} { return w.newTree(b) },
+		"arena":   func(b *testing.B, w *benchWorkload) interface{} { return newArenaTree(b, w) },
+	}
+
+	for _, layout := range []string{"pointer", "arena"} {
+		build := layouts[layout]
+		b.Run(layout, func(b *testing.B) {
+			runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+				b.StopTimer()
+				tree := build(b, w)
+				runtime.GC()
+				b.StartTimer()
+
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					runtime.GC()
+				}
+				b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N), "gc-ns/op")
+
+				runtime.KeepAlive(tree)
+			})
+		})
+	}
+}
+
+// nodes of a KDTree share the coordinates of the put key, so
+// the keys are copied to count them as part of the tree
+func newPointerTreeWithOwnKeys(b *testing.B, w *benchWorkload) interface{} {
+	tree, err := NewKDTree(w.dimensions, STORESIZE*100)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := range w.stored {
+		key := NewPoint(append(Key(nil), w.stored[i].key.coords...))
+		if err := tree.Put(&key, w.stored[i].value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return tree
+}
+
+func liveHeap() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// compares puts one by one with the bulk build on one and on all cores
+func BenchmarkBuild(b *testing.B) {
+	for _, workers := range append([]int{0}, benchWorkers()...) {
+		name := fmt.Sprintf("workers=%d", workers)
+		if workers == 0 {
+			name = "put"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+				keys := make([]Point, len(w.stored))
+				values := make([]Value, len(w.stored))
+				for i, kv := range w.stored {
+					keys[i], values[i] = kv.key, kv.value
+				}
+
+				for i := 0; i < b.N; i++ {
+					if workers == 0 {
+						w.newTree(b)
+					} else if _, err := BuildKDTree(w.dimensions, STORESIZE*100, keys, values, &BuildOptions{Workers: workers}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkParallelScanAll(b *testing.B) {
+	runParallelBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		for i := 0; i < b.N; i++ {
+			if _, err := w.tree.Scan(nil, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkBruteForceGetNN(b *testing.B) {
+	options := NNOptions{BruteForce: true}
+
+	runParallelBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		for i := 0; i < b.N; i++ {
+			if _, err := w.tree.GetNNWithOptions(&w.extra[i%len(w.extra)].key, &options); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// answers all extra keys in one batch, compare with 1000 times GetNN
+func BenchmarkGetNNBatch(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		keys := make([]*Point, len(w.extra))
+		for i := range keys {
+			keys[i] = &w.extra[i].key
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := w.tree.GetNNBatch(keys, 1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// joins the same keys as BenchmarkGetNNBatch, for comparison
+func BenchmarkJoinNearest(b *testing.B) {
+	runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+		queries, _ := NewKDTree(w.dimensions, STORESIZE)
+		for i := range w.extra {
+			if err := queries.Put(&w.extra[i].key, w.extra[i].value); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := JoinNearest(queries, w.tree); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// runs bench on the shared tree with one worker and with one per core
+func runParallelBenchmarks(b *testing.B, bench func(b *testing.B, w *benchWorkload)) {
+	for _, workers := range benchWorkers() {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			runBenchmarks(b, func(b *testing.B, w *benchWorkload) {
+				if err := w.tree.SetWorkers(workers); err != nil {
+					b.Fatal(err)
+				}
+				defer w.tree.SetWorkers(1)
+
+				bench(b, w)
+			})
+		})
+	}
+}
+
+// one worker and one per core, if there are several
+func benchWorkers() []int {
+	if runtime.GOMAXPROCS(0) == 1 {
+		return []int{1}
+	}
+	return []int{1, runtime.GOMAXPROCS(0)}
+}
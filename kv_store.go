@@ -5,14 +5,107 @@ Author: Tobias Famos & Mattia Pedrazzi
 
 package main
 
+import (
+	"errors"
+)
+
 type KVStoreOptions struct {
 	kSize int // key size
 	maxSize  int // Store size
 }
 
+// Range bounds every dimension from below and from above. A None
+// coordinate leaves the dimension unbounded on that side. Bounds are
+// inclusive like the ones of Scan, unless they are set exclusive.
 type Range struct {
-	minKey Point
-	maxKey Point
+	minKey       Point
+	maxKey       Point
+	minExclusive []bool
+	maxExclusive []bool
+}
+
+// returns the range between from and to with inclusive bounds,
+// a nil point leaves all dimensions unbounded on its side
+func NewRange(kSize int, from *Point, to *Point) (*Range, error) {
+	if (from != nil && from.GetSize() != kSize) || (to != nil && to.GetSize() != kSize) {
+		return nil, errors.New("wrong key size")
+	}
+
+	r := &Range{
+		minKey:       NewPoint(make(Key, kSize)),
+		maxKey:       NewPoint(make(Key, kSize)),
+		minExclusive: make([]bool, kSize),
+		maxExclusive: make([]bool, kSize),
+	}
+
+	for i := 0; i < kSize; i++ {
+		r.minKey.coords[i], r.maxKey.coords[i] = None(), None()
+		if from != nil {
+			r.minKey.coords[i] = from.coords[i]
+		}
+		if to != nil {
+			r.maxKey.coords[i] = to.coords[i]
+		}
+	}
+
+	return r, nil
+}
+
+// bounds dimension from below, an exclusive bound excludes value itself
+func (r *Range) SetLower(dimension int, value uint64, exclusive bool) error {
+	if dimension < 0 || dimension >= r.GetSize() {
+		return errors.New("dimension out of range")
+	}
+
+	r.minKey.coords[dimension] = UInt64(value)
+	r.minExclusive[dimension] = exclusive
+	return nil
+}
+
+// bounds dimension from above, an exclusive bound excludes value itself
+func (r *Range) SetUpper(dimension int, value uint64, exclusive bool) error {
+	if dimension < 0 || dimension >= r.GetSize() {
+		return errors.New("dimension out of range")
+	}
+
+	r.maxKey.coords[dimension] = UInt64(value)
+	r.maxExclusive[dimension] = exclusive
+	return nil
+}
+
+func (r *Range) GetSize() int {
+	return r.minKey.GetSize()
+}
+
+// checks value v of dimension i against the bounds of i
+func (r *Range) containsAt(i int, v uint64) bool {
+	if min := r.minKey.coords[i]; min.IsSome && (v < min.Value || (v == min.Value && r.minExclusive[i])) {
+		return false
+	}
+
+	if max := r.maxKey.coords[i]; max.IsSome && (v > max.Value || (v == max.Value && r.maxExclusive[i])) {
+		return false
+	}
+
+	return true
+}
+
+// reports whether a value below split may lie within the bounds of i
+func (r *Range) reachesBelow(i int, split uint64) bool {
+	min := r.minKey.coords[i]
+	return !min.IsSome || (min.Value < split && (!r.minExclusive[i] || min.Value+1 < split))
+}
+
+// reports whether a value of at most v may lie within the bounds of i
+func (r *Range) reachesUpTo(i int, v uint64) bool {
+	min := r.minKey.coords[i]
+	return !min.IsSome || min.Value < v || (min.Value == v && !r.minExclusive[i])
+}
+
+// reports whether a value of at least split may lie within the bounds of i
+func (r *Range) reachesFrom(i int, split uint64) bool {
+	max := r.maxKey.coords[i]
+	return !max.IsSome || split < max.Value || (split == max.Value && !r.maxExclusive[i])
 }
 
 type KVStore interface {
@@ -22,6 +115,7 @@ type KVStore interface {
 	Scan(from *Point, to *Point) ([]Value, error) // range query
 	GetNN(key *Point) (Value, error) // nearest neighbour query
 	Upsert(key *Point, value Value) error
+	Stats() *TreeStats // shape and keys of the store
 }
 
 type KVStoreMock struct {
@@ -71,3 +165,7 @@ func (k *KVStoreMock) Upsert(key *Point, value Value) error {
 func (k *KVStoreMock) Scan(from *Point, to *Point) ([]Value, error) {
 	return make([]Value, 0), nil
 }
+
+func (k *KVStoreMock) Stats() *TreeStats {
+	return &TreeStats{MaxSize: uint64(k.size)}
+}
@@ -6,12 +6,15 @@ Author: Mattia Pedrazzi & Tobias Famos
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"math"
 	"math/rand"
+	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
-	"time"
 )
 
 const (
@@ -200,6 +203,212 @@ func runDeletionTest(t *testing.T, indexToDelete int) {
 	}
 }
 
+func TestDeleteReturning(t *testing.T) {
+	store, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
+
+	data := RandString()
+	point1 := NewPoint(Key{UInt64(0), UInt64(0), UInt64(0)})
+	point2 := NewPoint(Key{UInt64(1), UInt64(1), UInt64(1)})
+
+	assert.NoError(t, store.Put(&point1, RandString()))
+	assert.NoError(t, store.Put(&point2, data))
+
+	if value, err := store.DeleteReturning(&point2); assert.NoError(t, err) {
+		assert.Equal(t, data, value)
+	}
+
+	_, err = store.Get(&point2)
+	assert.Error(t, err)
+
+	_, err = store.DeleteReturning(&point2)
+	assert.Error(t, err)
+}
+
+func TestDeleteRootLeaf(t *testing.T) {
+	store, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
+
+	point := NewPoint(Key{UInt64(0), UInt64(0), UInt64(0)})
+	assert.NoError(t, store.Put(&point, RandString()))
+
+	assert.NoError(t, store.Delete(&point))
+	assert.Error(t, store.Delete(&point))
+}
+
+func TestDeleteMatching3D(t *testing.T) {
+	store, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
+	oldData := RandString()
+
+	// create and store points
+	point1 := NewPoint(Key{UInt64(0), UInt64(0), UInt64(0)})
+	point2 := NewPoint(Key{UInt64(1), UInt64(1), UInt64(1)})
+	point3 := NewPoint(Key{UInt64(1), UInt64(2), UInt64(2)})
+	point4 := NewPoint(Key{UInt64(2), UInt64(3), UInt64(2)})
+	point5 := NewPoint(Key{UInt64(1), UInt64(3), UInt64(3)})
+
+	assert.NoError(t, store.Put(&point1, oldData))
+	assert.NoError(t, store.Put(&point2, oldData))
+	assert.NoError(t, store.Put(&point3, oldData))
+	assert.NoError(t, store.Put(&point4, oldData))
+	assert.NoError(t, store.Put(&point5, oldData))
+
+	searchPoint := NewPoint(Key{UInt64(1), None(), None()})
+
+	if count, err := store.DeleteMatching(&searchPoint); assert.NoError(t, err) {
+		assert.Equal(t, 3, count)
+	}
+
+	entries, err := store.Get(&searchPoint)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+
+	for _, p := range []Point{point1, point4} {
+		_, err := store.Get(&p)
+		assert.NoError(t, err)
+	}
+}
+
+func TestDeleteRange3D(t *testing.T) {
+	store, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
+	oldData := RandString()
+
+	// create and store points
+	point1 := NewPoint(Key{UInt64(0), UInt64(0), UInt64(0)})
+	point2 := NewPoint(Key{UInt64(1), UInt64(1), UInt64(1)})
+	point3 := NewPoint(Key{UInt64(2), UInt64(2), UInt64(2)})
+	point4 := NewPoint(Key{UInt64(2), UInt64(3), UInt64(2)})
+	point5 := NewPoint(Key{UInt64(3), UInt64(3), UInt64(3)})
+
+	assert.NoError(t, store.Put(&point1, oldData))
+	assert.NoError(t, store.Put(&point2, oldData))
+	assert.NoError(t, store.Put(&point3, oldData))
+	assert.NoError(t, store.Put(&point4, oldData))
+	assert.NoError(t, store.Put(&point5, oldData))
+
+	from := NewPoint(Key{UInt64(1), UInt64(1), UInt64(1)})
+	to := NewPoint(Key{UInt64(2), UInt64(2), UInt64(2)})
+
+	if count, err := store.DeleteRange(&from, &to); assert.NoError(t, err) {
+		assert.Equal(t, 2, count)
+	}
+
+	entries, err := store.Scan(nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	entries, err = store.Scan(&from, &to)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestDeleteKeepsInvariant(t *testing.T) {
+	for _, strategy := range []SplitStrategy{RoundRobin, MaxSpread, MaxVariance} {
+		for _, dimensions := range []int{1, 2, 3, 5} {
+			rand.Seed(int64(dimensions))
+			runInvariantTest(t, dimensions, strategy, 300)
+		}
+	}
+}
+
+// puts and deletes random keys from a small range,
+// so that duplicates are common, and validates the
+// tree after every operation
+func runInvariantTest(t *testing.T, dimensions int, strategy SplitStrategy, operations int) {
+	store, err := NewKDTreeWithStrategy(dimensions, STORESIZE, strategy)
+	assert.NoError(t, err)
+
+	var stored []Point
+
+	for i := 0; i < operations; i++ {
+		if len(stored) == 0 || rand.Intn(3) > 0 {
+			key := make(Key, dimensions)
+			for d := 0; d < dimensions; d++ {
+				key[d] = UInt64(uint64(rand.Intn(8)))
+			}
+			point := NewPoint(key)
+			assert.NoError(t, store.Put(&point, RandString()))
+			stored = append(stored, point)
+		} else {
+			index := rand.Intn(len(stored))
+			assert.NoError(t, store.Delete(&stored[index]))
+			stored = append(stored[:index], stored[index+1:]...)
+		}
+
+		if !assert.NoError(t, store.Validate()) {
+			return
+		}
+	}
+
+	for len(stored) > 0 {
+		assert.NoError(t, store.Delete(&stored[0]))
+		stored = stored[1:]
+		if !assert.NoError(t, store.Validate()) {
+			return
+		}
+	}
+
+	assert.Nil(t, store.root)
+}
+
+func TestSplitStrategies(t *testing.T) {
+	for _, strategy := range []SplitStrategy{MaxSpread, MaxVariance} {
+		store, err := NewKDTreeWithStrategy(3, STORESIZE, strategy)
+		assert.NoError(t, err)
+
+		// only the last coordinate varies
+		for i := 0; i < 20; i++ {
+			point := NewPoint(Key{UInt64(5), UInt64(5), UInt64(uint64(i * 7 % 20))})
+			assert.NoError(t, store.Put(&point, RandString()))
+		}
+
+		// nothing to choose from for the root
+		assert.Equal(t, 0, store.root.GetAxis())
+		assert.Equal(t, 2, store.root.Right.GetAxis())
+		assert.NoError(t, store.Validate())
+
+		searchPoint := NewPoint(Key{None(), None(), UInt64(7)})
+		entries, err := store.Get(&searchPoint)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+	}
+
+	store, err := NewKDTreeWithStrategy(3, STORESIZE, RoundRobin)
+	assert.NoError(t, err)
+	_, _, toStore := createValues(3, 20)
+	for _, kv := range toStore {
+		assert.NoError(t, store.Put(&kv.key, kv.value))
+	}
+	assert.Equal(t, 0, store.root.GetAxis())
+	for _, child := range []*Node{store.root.Left, store.root.Right} {
+		if child != nil {
+			assert.Equal(t, 1, child.GetAxis())
+		}
+	}
+
+	_, err = NewKDTreeWithStrategy(3, STORESIZE, SplitStrategy(7))
+	assert.Error(t, err)
+}
+
+func TestGetNNWithStrategies(t *testing.T) {
+	for _, strategy := range []SplitStrategy{RoundRobin, MaxSpread, MaxVariance} {
+		store, err := NewKDTreeWithStrategy(10, STORESIZE, strategy)
+		assert.NoError(t, err)
+
+		toSearch, toFind, toStore := createValues(10, 300)
+
+		for _, kv := range toStore {
+			assert.NoError(t, store.Put(&kv.key, kv.value))
+		}
+
+		if result, err := store.GetNN(&toSearch.key); assert.NoError(t, err) {
+			assert.Equal(t, toFind.value, result)
+		}
+	}
+}
+
 func TestUpsert(t *testing.T) {
 	store, err := NewKDTree(3, STORESIZE)
 	assert.NoError(t, err)
@@ -566,179 +775,1755 @@ func TestGetNN10D(t *testing.T) {
 	}
 }
 
-func Test100DBenchMark(t *testing.T) {
-
-	fmt.Println("\nRunning 100D Benchmark")
+func TestGetNNApproximate(t *testing.T) {
+	rand.Seed(30)
 
-	store, err := NewKDTree(100, STORESIZE*100)
+	store, err := NewKDTree(10, STORESIZE)
 	assert.NoError(t, err)
 
-	toSearch, toFind, toStore := createValues(100, 500000) // 100D and 500 values stored
-
-	t0 := time.Now().UnixMicro()
+	toSearch, toFind, toStore := createValues(10, 2000)
+	_, exactDistance := toSearch.key.GetDistance(&toFind.key)
 
+	reference := NewReferenceStore(10)
 	for _, kv := range toStore {
 		assert.NoError(t, store.Put(&kv.key, kv.value))
+		assert.NoError(t, reference.Put(&kv.key, kv.value))
 	}
 
-	t1 := time.Now().UnixMicro()
+	for _, epsilon := range []float64{0, 0.1, 0.5, 2} {
+		result, err := store.GetNNWithOptions(&toSearch.key, &NNOptions{Epsilon: epsilon})
+		if assert.NoError(t, err) {
+			found, ok := reference.keyOf(result)
+			assert.True(t, ok)
+			_, distance := toSearch.key.GetDistance(found)
+			assert.LessOrEqual(t, distance, exactDistance*(1+epsilon))
+		}
+	}
 
-	if result, err := store.GetNN(&toSearch.key); assert.NoError(t, err) {
+	if result, err := store.GetNNWithOptions(&toSearch.key, &NNOptions{}); assert.NoError(t, err) {
 		assert.Equal(t, toFind.value, result)
 	}
+}
+
+func TestGetNNMaxVisits(t *testing.T) {
+	store, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
+
+	_, _, toStore := createValues(3, 100)
+	for _, kv := range toStore {
+		assert.NoError(t, store.Put(&kv.key, kv.value))
+	}
+
+	// only the root is visited
+	key := NewPoint(Key{UInt64(0), UInt64(0), UInt64(0)})
+	if result, err := store.GetNNWithOptions(&key, &NNOptions{MaxVisits: 1}); assert.NoError(t, err) {
+		assert.Equal(t, toStore[0].value, result)
+	}
 
-	t2 := time.Now().UnixMicro()
+	_, err = store.GetNNWithOptions(&key, &NNOptions{MaxVisits: -1})
+	assert.Error(t, err)
 
-	getTime := benchmarkGet(t, store, toStore)
-	scanTime := benchmarkScan(t, store, toStore)
+	_, err = store.GetNNWithOptions(&key, &NNOptions{Epsilon: -0.5})
+	assert.Error(t, err)
 
-	fmt.Println("Store Time [μs]", t1-t0)
-	fmt.Println("Get Time [μs]", getTime)
-	fmt.Println("NN Time [μs]", t2-t1)
-	fmt.Println("Scan Time [μs]", scanTime)
+	_, err = store.GetNNWithOptions(&key, &NNOptions{Epsilon: math.NaN()})
+	assert.Error(t, err)
 
+	_, err = store.GetNNWithOptions(&key, &NNOptions{Epsilon: math.Inf(1)})
+	assert.Error(t, err)
 }
 
-func Test10DBenchMark(t *testing.T) {
+func TestGetKNNLargeEpsilon(t *testing.T) {
+	tree, _ := NewKDTree(3, STORESIZE*100)
+	arena, _ := NewArenaKDTree(3)
+	forest, _ := NewKDForest(3, &KDForestOptions{Seed: 1})
+
+	_, _, toStore := createValues(3, 100)
+	for _, kv := range toStore {
+		assert.NoError(t, tree.Put(&kv.key, kv.value))
+		assert.NoError(t, arena.Put(&kv.key, kv.value))
+		assert.NoError(t, forest.Put(&kv.key, kv.value))
+	}
 
-	fmt.Println("\nRunning 10D Benchmark")
+	// nothing may be pruned before k keys are found,
+	// however far the scaled distances overflow
+	key := NewPoint(Key{UInt64(0), UInt64(0), UInt64(0)})
+	options := &NNOptions{Epsilon: 1e200}
 
-	store, err := NewKDTree(10, STORESIZE*100)
-	assert.NoError(t, err)
+	for _, store := range []interface {
+		GetKNNWithOptions(key *Point, k int, options *NNOptions) ([]Value, error)
+	}{tree, arena, forest} {
+		if result, err := store.GetKNNWithOptions(&key, 5, options); assert.NoError(t, err) {
+			assert.Len(t, result, 5)
+		}
+	}
+}
 
-	toSearch, toFind, toStore := createValues(10, 500000) // 100D and 500 values stored
+func TestGetKNN3D(t *testing.T) {
+	store, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
 
-	t0 := time.Now().UnixMicro()
+	toSearch, toFind, toStore := createValues(3, 200)
 
 	for _, kv := range toStore {
 		assert.NoError(t, store.Put(&kv.key, kv.value))
 	}
 
-	t1 := time.Now().UnixMicro()
+	if result, err := store.GetKNN(&toSearch.key, 10); assert.NoError(t, err) {
+		assert.Len(t, result, 10)
+		assert.Equal(t, toFind.value, result[0])
+		assert.Equal(t, nearestDistances(toSearch.key, toStore, 10), distancesOf(toSearch.key, toStore, result))
+	}
 
-	if result, err := store.GetNN(&toSearch.key); assert.NoError(t, err) {
-		assert.Equal(t, toFind.value, result)
+	// asking for more than stored returns all
+	if result, err := store.GetKNN(&toSearch.key, 500); assert.NoError(t, err) {
+		assert.Len(t, result, len(toStore))
 	}
 
-	t2 := time.Now().UnixMicro()
+	_, err = store.GetKNN(&toSearch.key, 0)
+	assert.Error(t, err)
+}
+
+func TestForestGetNN(t *testing.T) {
+	for _, dimensions := range []int{2, 10, 50} {
+		forest, err := NewKDForest(dimensions, &KDForestOptions{Seed: 31})
+		assert.NoError(t, err)
 
-	getTime := benchmarkGet(t, store, toStore)
-	scanTime := benchmarkScan(t, store, toStore)
+		toSearch, toFind, toStore := createValues(dimensions, 500)
 
-	fmt.Println("Store Time [μs]", t1-t0)
-	fmt.Println("Get Time [μs]", getTime)
-	fmt.Println("NN Time [μs]", t2-t1)
-	fmt.Println("Scan Time [μs]", scanTime)
+		for _, kv := range toStore {
+			assert.NoError(t, forest.Put(&kv.key, kv.value))
+		}
 
-}
+		if result, err := forest.GetNN(&toSearch.key); assert.NoError(t, err) {
+			assert.Equal(t, toFind.value, result)
+		}
+
+		if result, err := forest.GetKNN(&toSearch.key, 5); assert.NoError(t, err) {
+			assert.Equal(t, nearestDistances(toSearch.key, toStore, 5), distancesOf(toSearch.key, toStore, result))
+		}
 
-func Test3DBenchMark(t *testing.T) {
+		// a bounded search still returns a stored value
+		if result, err := forest.GetNNWithOptions(&toSearch.key, &NNOptions{MaxVisits: 20}); assert.NoError(t, err) {
+			assert.NotEmpty(t, distancesOf(toSearch.key, toStore, []Value{result}))
+		}
+	}
+}
 
-	fmt.Println("\nRunning 3D Benchmark")
+func TestForestWrongKey(t *testing.T) {
+	_, err := NewKDForest(0, nil)
+	assert.Error(t, err)
 
-	store, err := NewKDTree(3, STORESIZE*100)
+	forest, err := NewKDForest(3, nil)
 	assert.NoError(t, err)
 
-	toSearch, toFind, toStore := createValues(3, 500000) // 100D and 500 values stored
+	point := NewPoint(Key{UInt64(0), UInt64(0), UInt64(0)})
+	_, err = forest.GetNN(&point)
+	assert.Error(t, err, "empty forest")
+
+	wrong := NewPoint(Key{UInt64(0), UInt64(0)})
+	assert.Error(t, forest.Put(&wrong, RandString()))
 
-	t0 := time.Now().UnixMicro()
+	partial := NewPoint(Key{UInt64(0), None(), UInt64(0)})
+	assert.Error(t, forest.Put(&partial, RandString()))
+}
+
+func TestBucketTree(t *testing.T) {
+	store, err := NewBucketKDTree(3, 4)
+	assert.NoError(t, err)
+
+	toSearch, toFind, toStore := createValues(3, 300)
 
 	for _, kv := range toStore {
 		assert.NoError(t, store.Put(&kv.key, kv.value))
 	}
-
-	t1 := time.Now().UnixMicro()
+	assert.NoError(t, store.Validate())
+	assert.False(t, store.root.isLeaf())
 
 	if result, err := store.GetNN(&toSearch.key); assert.NoError(t, err) {
 		assert.Equal(t, toFind.value, result)
 	}
 
-	t2 := time.Now().UnixMicro()
+	if result, err := store.GetKNN(&toSearch.key, 7); assert.NoError(t, err) {
+		assert.Equal(t, nearestDistances(toSearch.key, toStore, 7), distancesOf(toSearch.key, toStore, result))
+	}
 
-	getTime := benchmarkGet(t, store, toStore)
-	scanTime := benchmarkScan(t, store, toStore)
+	entries, err := store.Scan(nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, entries, len(toStore))
 
-	fmt.Println("Store Time [μs]", t1-t0)
-	fmt.Println("Get Time [μs]", getTime)
-	fmt.Println("NN Time [μs]", t2-t1)
-	fmt.Println("Scan Time [μs]", scanTime)
+	for _, kv := range toStore {
+		if result, err := store.Get(&kv.key); assert.NoError(t, err) {
+			assert.Equal(t, kv.value, result[0])
+		}
+		assert.NoError(t, store.Delete(&kv.key))
+	}
+	assert.NoError(t, store.Validate())
+	assert.True(t, store.root.isLeaf())
 
+	_, err = store.GetNN(&toSearch.key)
+	assert.Error(t, err, "empty tree")
 }
 
+func TestBucketTreeScanRange3D(t *testing.T) {
+	store, err := NewBucketKDTree(3, 2)
+	assert.NoError(t, err)
+	oldData := RandString()
 
-func benchmarkGet(t *testing.T, store *KDTree, storedValues []KeyValuePair) int64 {
+	// create and store points
+	point1 := NewPoint(Key{UInt64(0), UInt64(0), UInt64(0)})
+	point2 := NewPoint(Key{UInt64(1), UInt64(1), UInt64(1)})
+	point3 := NewPoint(Key{UInt64(2), UInt64(2), UInt64(2)})
+	point4 := NewPoint(Key{UInt64(2), UInt64(3), UInt64(2)})
+	point5 := NewPoint(Key{UInt64(3), UInt64(3), UInt64(3)})
 
-	totOp := 10
+	assert.NoError(t, store.Put(&point1, oldData))
+	assert.NoError(t, store.Put(&point2, oldData))
+	assert.NoError(t, store.Put(&point3, oldData))
+	assert.NoError(t, store.Put(&point4, oldData))
+	assert.NoError(t, store.Put(&point5, oldData))
 
-	var timeSum int64 = 0
+	from := NewPoint(Key{UInt64(1), UInt64(1), UInt64(1)})
+	to := NewPoint(Key{UInt64(3), UInt64(3), UInt64(3)})
 
-	for i := 0; i < totOp; i ++ {
-		t0 := time.Now().UnixMicro()
-		_, err := store.Get(&storedValues[rand.Intn(len(storedValues))].key)
-		assert.NoError(t, err)
-		timeSum += (time.Now().UnixMicro() - t0)
-	}
+	entries, err := store.Scan(&from, &to)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
 
-	return timeSum / int64(totOp)
+	searchPoint := NewPoint(Key{UInt64(2), None(), None()})
+	entries, err = store.Get(&searchPoint)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
 }
 
-// worst case -> scan whole tree
-func benchmarkScan(t *testing.T, store *KDTree, storedValues []KeyValuePair) uint64 {
+func TestBucketTreeDuplicates(t *testing.T) {
+	store, err := NewBucketKDTree(2, 2)
+	assert.NoError(t, err)
 
-	totOp := 100
+	// equal keys cannot be split and stay in one leaf
+	point := NewPoint(Key{UInt64(4), UInt64(4)})
+	values := []Value{RandString(), RandString(), RandString(), RandString()}
+	for _, v := range values {
+		assert.NoError(t, store.Put(&point, v))
+	}
+	assert.NoError(t, store.Validate())
 
-	var timeSum uint64 = 0
+	if result, err := store.Get(&point); assert.NoError(t, err) {
+		assert.Equal(t, values[0], result[0])
+	}
 
-	for i := 0; i < totOp; i ++ {
-		t0 := time.Now().UnixMicro()
-		_, err := store.Scan(
-			nil, 
-			nil)
-		assert.NoError(t, err)
-		timeSum += uint64(time.Now().UnixMicro() - t0)
+	assert.NoError(t, store.Delete(&point))
+	if result, err := store.Get(&point); assert.NoError(t, err) {
+		assert.Equal(t, values[1], result[0])
 	}
 
-	return timeSum / uint64(totOp)
+	_, err = NewBucketKDTree(2, -1)
+	assert.Error(t, err)
 }
 
+func TestArenaTree(t *testing.T) {
+	store, err := NewArenaKDTree(3)
+	assert.NoError(t, err)
 
+	toSearch, toFind, toStore := createValues(3, 300)
 
+	for _, kv := range toStore {
+		assert.NoError(t, store.Put(&kv.key, kv.value))
+	}
+	assert.NoError(t, store.Validate())
+	assert.Equal(t, len(toStore), store.Len())
 
-// create values for different dimensions
-// first return value is the value to search
-// second is the nearest neighbour
-func createValues(dimensions int, keyValuePairsCount int) (KeyValuePair, KeyValuePair, []KeyValuePair) {
+	if result, err := store.GetNN(&toSearch.key); assert.NoError(t, err) {
+		assert.Equal(t, toFind.value, result)
+	}
 
-	keyValuePairs := make([]KeyValuePair, keyValuePairsCount)
+	if result, err := store.GetKNN(&toSearch.key, 7); assert.NoError(t, err) {
+		assert.Equal(t, nearestDistances(toSearch.key, toStore, 7), distancesOf(toSearch.key, toStore, result))
+	}
 
-	for i := 0; i < keyValuePairsCount; i++ {
-		data := RandString()
-		key := make(Key, dimensions)
+	// deleted slots are reused
+	for _, kv := range toStore[:100] {
+		assert.NoError(t, store.Delete(&kv.key))
+	}
+	assert.NoError(t, store.Validate())
+	for _, kv := range toStore[:100] {
+		assert.NoError(t, store.Put(&kv.key, kv.value))
+	}
+	assert.NoError(t, store.Validate())
+	assert.Len(t, store.nodes, len(toStore))
 
-		for d := 0; d < dimensions; d++ {
-			key[d] = UInt64(randomUint64())
+	for _, kv := range toStore {
+		if result, err := store.Get(&kv.key); assert.NoError(t, err) {
+			assert.Equal(t, kv.value, result[0])
 		}
-
-		keyValuePairs[i] = KeyValuePair{key: NewPoint(key), value: data}
 	}
+}
 
-	min := math.MaxFloat64
+func TestArenaTreeLikeKDTree(t *testing.T) {
+	r := rand.New(rand.NewSource(17))
 
-	toSearch := keyValuePairs[0]
-	toStore := keyValuePairs[1:]
-	var nearest KeyValuePair
+	arena, _ := NewArenaKDTree(3)
+	tree, _ := NewKDTree(3, STORESIZE)
 
-	for _, kv := range toStore {
-		_, distance := toSearch.key.GetDistance(&kv.key)
-		if distance < min {
-			min = distance
-			nearest = kv
+	stored := make([]KeyValuePair, 500)
+	for i := range stored {
+		stored[i] = KeyValuePair{
+			key:   NewPoint(Key{UInt64(uint64(r.Intn(10))), UInt64(uint64(r.Intn(50))), UInt64(uint64(r.Intn(50)))}),
+			value: RandString(),
 		}
+		assert.NoError(t, arena.Put(&stored[i].key, stored[i].value))
+		assert.NoError(t, tree.Put(&stored[i].key, stored[i].value))
 	}
+	assert.Equal(t, tree.GetNodesCount(), arena.GetNodesCount())
 
-	return toSearch, nearest, toStore
+	query := NewPoint(Key{UInt64(5), UInt64(25), UInt64(25)})
+	filter := NewPoint(Key{UInt64(3), None(), None()})
+	even := func(key *Point, value Value) bool { return key.coords[1].Value%2 == 0 }
+
+	for _, options := range []*NNOptions{nil, {BruteForce: true}, {Filter: &filter}, {Accept: even}, {Filter: &filter, Accept: even, BruteForce: true}} {
+		values, err := arena.GetKNNWithOptions(&query, 10, options)
+		expected, _ := tree.GetKNNWithOptions(&query, 10, options)
+		if assert.NoError(t, err) {
+			assert.Equal(t, distancesOf(query, stored, expected), distancesOf(query, stored, values))
+		}
+	}
+
+	// an approximate search still returns a stored value
+	if value, err := arena.GetNNWithOptions(&query, &NNOptions{MaxVisits: 5, Epsilon: 0.5}); assert.NoError(t, err) {
+		assert.Len(t, distancesOf(query, stored, []Value{value}), 1)
+	}
+
+	missing := NewPoint(Key{UInt64(99), None(), None()})
+	_, err := arena.GetNNWithOptions(&query, &NNOptions{Filter: &missing})
+	assert.Error(t, err)
+
+	if value, err := arena.DeleteReturning(&stored[0].key); assert.NoError(t, err) {
+		expected, _ := tree.DeleteReturning(&stored[0].key)
+		assert.Equal(t, expected, value)
+	}
+
+	deleted, err := arena.DeleteMatching(&filter)
+	expected, _ := tree.DeleteMatching(&filter)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, deleted)
+	assert.Greater(t, deleted, 0)
+
+	from := NewPoint(Key{None(), UInt64(10), UInt64(10)})
+	to := NewPoint(Key{None(), UInt64(30), UInt64(30)})
+	deleted, err = arena.DeleteRange(&from, &to)
+	expected, _ = tree.DeleteRange(&from, &to)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, deleted)
+	assert.Greater(t, deleted, 0)
+
+	assert.NoError(t, arena.Validate())
+	assert.Equal(t, tree.GetNodesCount(), arena.GetNodesCount())
+
+	all := NewPoint(Key{None(), None(), None()})
+	values, _ := arena.Scan(&all, &all)
+	remaining, _ := tree.Scan(&all, &all)
+	assert.ElementsMatch(t, remaining, values)
+
+	wrong := NewPoint(Key{UInt64(1)})
+	_, err = arena.DeleteMatching(&wrong)
+	assert.Error(t, err)
+	_, err = arena.DeleteRange(&wrong, nil)
+	assert.Error(t, err)
 }
 
-func randomUint64() uint64 {
-	return uint64(rand.Uint32()) // avoid overflows!!
+func TestArenaTreePartialGet3D(t *testing.T) {
+	store, err := NewArenaKDTree(3)
+	assert.NoError(t, err)
+	oldData := RandString()
+	toFind1 := RandString()
+	toFind2 := RandString()
+	toFind3 := RandString()
+
+	// create and store points
+	point1 := NewPoint(Key{UInt64(0), UInt64(0), UInt64(0)})
+	point2 := NewPoint(Key{UInt64(1), UInt64(1), UInt64(1)})
+	point3 := NewPoint(Key{UInt64(1), UInt64(2), UInt64(2)})
+	point4 := NewPoint(Key{UInt64(2), UInt64(3), UInt64(2)})
+	point5 := NewPoint(Key{UInt64(1), UInt64(3), UInt64(3)})
+
+	assert.NoError(t, store.Put(&point1, oldData))
+	assert.NoError(t, store.Put(&point2, toFind1))
+	assert.NoError(t, store.Put(&point3, toFind2))
+	assert.NoError(t, store.Put(&point4, oldData))
+	assert.NoError(t, store.Put(&point5, toFind3))
+
+	searchPoint := NewPoint(Key{UInt64(1), None(), None()})
+
+	entries, err := store.Get(&searchPoint)
+	assert.NoError(t, err)
+	assert.Equal(t, []Value{toFind1, toFind2, toFind3}, entries)
+
+	from := NewPoint(Key{UInt64(1), UInt64(1), UInt64(1)})
+	to := NewPoint(Key{UInt64(3), UInt64(3), UInt64(3)})
+
+	entries, err = store.Scan(&from, &to)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
+}
+
+func TestBuildKDTree(t *testing.T) {
+	toSearch, toFind, toStore := createValues(3, 1000)
+
+	keys := make([]Point, len(toStore))
+	values := make([]Value, len(toStore))
+	for i, kv := range toStore {
+		keys[i], values[i] = kv.key, kv.value
+	}
+
+	for _, strategy := range []SplitStrategy{RoundRobin, MaxSpread, MaxVariance} {
+		for _, workers := range []int{1, 4} {
+			store, err := BuildKDTree(3, STORESIZE, keys, values, &BuildOptions{Workers: workers, Strategy: strategy})
+			assert.NoError(t, err)
+			assert.NoError(t, store.Validate())
+			assert.Equal(t, len(toStore), store.GetNodesCount())
+
+			// median splits, 1000 keys fit into 10 levels
+			assert.LessOrEqual(t, depthOf(store.root), 10)
+
+			for _, kv := range toStore {
+				if result, err := store.Get(&kv.key); assert.NoError(t, err) {
+					assert.Equal(t, kv.value, result[0])
+				}
+			}
+
+			if result, err := store.GetNN(&toSearch.key); assert.NoError(t, err) {
+				assert.Equal(t, toFind.value, result)
+			}
+
+			// later puts and deletes keep the tree valid
+			assert.NoError(t, store.Put(&toSearch.key, toSearch.value))
+			for _, kv := range toStore[:100] {
+				assert.NoError(t, store.Delete(&kv.key))
+			}
+			assert.NoError(t, store.Validate())
+		}
+	}
+
+	_, err := BuildKDTree(3, STORESIZE, keys, values[1:], nil)
+	assert.Error(t, err)
+
+	_, err = BuildKDTree(2, STORESIZE, keys, values, nil)
+	assert.Error(t, err)
+
+	_, err = BuildKDTree(3, STORESIZE, keys, values, &BuildOptions{Workers: -1})
+	assert.Error(t, err)
+}
+
+func TestBuildKDTreeDuplicates(t *testing.T) {
+	point := NewPoint(Key{UInt64(4), UInt64(4)})
+	other := NewPoint(Key{UInt64(4), UInt64(2)})
+
+	keys := []Point{point, other, point, point, other}
+	values := []Value{RandString(), RandString(), RandString(), RandString(), RandString()}
+
+	store, err := BuildKDTree(2, STORESIZE, keys, values, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Validate())
+
+	// the earliest of equal keys is found, like after puts
+	if result, err := store.Get(&point); assert.NoError(t, err) {
+		assert.Equal(t, values[0], result[0])
+	}
+
+	assert.NoError(t, store.Delete(&point))
+	if result, err := store.Get(&point); assert.NoError(t, err) {
+		assert.Equal(t, values[2], result[0])
+	}
+
+	// many equal coordinates and keys
+	keys, values = make([]Point, 500), make([]Value, 500)
+	first := map[[2]uint64]Value{}
+	for i := range keys {
+		x, y := uint64(rand.Intn(6)), uint64(rand.Intn(6))
+		keys[i], values[i] = NewPoint(Key{UInt64(x), UInt64(y)}), RandString()
+		if _, ok := first[[2]uint64{x, y}]; !ok {
+			first[[2]uint64{x, y}] = values[i]
+		}
+	}
+
+	store, err = BuildKDTree(2, STORESIZE, keys, values, &BuildOptions{Workers: 4, Strategy: MaxSpread})
+	assert.NoError(t, err)
+	assert.NoError(t, store.Validate())
+	for _, key := range keys {
+		if result, err := store.Get(&key); assert.NoError(t, err) {
+			assert.Equal(t, first[[2]uint64{key.coords[0].Value, key.coords[1].Value}], result[0])
+		}
+	}
+
+	empty, err := BuildKDTree(2, STORESIZE, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, empty.Put(&point, values[0]))
+}
+
+func TestParallelQueries(t *testing.T) {
+	toSearch, _, toStore := createValues(3, 2000)
+
+	sequential, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
+	parallel, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
+	assert.NoError(t, parallel.SetWorkers(4))
+	assert.Error(t, parallel.SetWorkers(0))
+
+	for _, kv := range toStore {
+		assert.NoError(t, sequential.Put(&kv.key, kv.value))
+		assert.NoError(t, parallel.Put(&kv.key, kv.value))
+	}
+
+	// results come in the same order
+	from := NewPoint(Key{UInt64(1 << 30), None(), UInt64(1 << 29)})
+	to := NewPoint(Key{UInt64(1 << 31), UInt64(1 << 31), None()})
+	expected, err := sequential.Scan(&from, &to)
+	assert.NoError(t, err)
+	if result, err := parallel.Scan(&from, &to); assert.NoError(t, err) {
+		assert.NotEmpty(t, result)
+		assert.Equal(t, expected, result)
+	}
+
+	expected, _ = sequential.Scan(nil, nil)
+	if result, err := parallel.Scan(nil, nil); assert.NoError(t, err) {
+		assert.Equal(t, expected, result)
+	}
+
+	partial := NewPoint(Key{None(), toStore[7].key.coords[1], None()})
+	expected, _ = sequential.Get(&partial)
+	if result, err := parallel.Get(&partial); assert.NoError(t, err) {
+		assert.Equal(t, expected, result)
+	}
+
+	for _, store := range []*KDTree{sequential, parallel} {
+		result, err := store.GetKNNWithOptions(&toSearch.key, 9, &NNOptions{BruteForce: true})
+		if assert.NoError(t, err) {
+			assert.Equal(t, nearestDistances(toSearch.key, toStore, 9), distancesOf(toSearch.key, toStore, result))
+		}
+	}
+}
+
+func TestGetNNBatch(t *testing.T) {
+	store, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
+
+	_, err = store.GetNNBatch(nil, 1)
+	assert.Error(t, err)
+
+	_, queries, toStore := createValues(3, 600)
+	for _, kv := range toStore[100:] {
+		assert.NoError(t, store.Put(&kv.key, kv.value))
+	}
+
+	keys := make([]*Point, 100)
+	for i := range keys {
+		keys[i] = &toStore[i].key
+	}
+
+	for _, options := range []*NNOptions{nil, {Epsilon: 1}, {MaxVisits: 20}, {BruteForce: true}} {
+		results, err := store.GetNNBatchWithOptions(keys, 5, options)
+		assert.NoError(t, err)
+		assert.Len(t, results, len(keys))
+
+		// same results in the same order as single queries
+		for i, key := range keys {
+			if expected, err := store.GetKNNWithOptions(key, 5, options); assert.NoError(t, err) {
+				assert.Equal(t, distancesOf(*key, toStore, expected), distancesOf(*key, toStore, results[i]))
+			}
+		}
+	}
+
+	results, err := store.GetNNBatch([]*Point{&queries.key}, 1000)
+	assert.NoError(t, err)
+	assert.Len(t, results[0], len(toStore)-100)
+
+	// k is clamped to the number of keys before allocating the results
+	results, err = store.GetNNBatch([]*Point{&queries.key, &queries.key}, math.MaxInt/2)
+	if assert.NoError(t, err) {
+		assert.Len(t, results[1], len(toStore)-100)
+		assert.Equal(t, results[0], results[1])
+	}
+
+	_, err = store.GetNNBatch([]*Point{&queries.key, nil}, 1)
+	assert.Error(t, err)
+
+	_, err = store.GetNNBatch(keys, 0)
+	assert.Error(t, err)
+}
+
+func TestCount3D(t *testing.T) {
+	store, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
+
+	_, _, toStore := createValues(3, 1000)
+	for _, kv := range toStore {
+		assert.NoError(t, store.Put(&kv.key, kv.value))
+	}
+
+	check := func() {
+		for i := 0; i < 50; i++ {
+			from := NewPoint(Key{UInt64(randomUint64() / 2), None(), UInt64(randomUint64() / 4)})
+			to := NewPoint(Key{UInt64(randomUint64()/2 + 1<<31), UInt64(randomUint64()), None()})
+
+			scanned, _ := store.Scan(&from, &to)
+			if count, err := store.Count(&from, &to); assert.NoError(t, err) {
+				assert.Equal(t, len(scanned), count)
+			}
+		}
+
+		all, _ := store.Scan(nil, nil)
+		if count, err := store.Count(nil, nil); assert.NoError(t, err) {
+			assert.Equal(t, len(all), count)
+		}
+	}
+
+	check()
+
+	for _, kv := range toStore[:300] {
+		assert.NoError(t, store.Delete(&kv.key))
+	}
+	assert.NoError(t, store.Validate())
+	check()
+
+	partial := NewPoint(Key{None(), toStore[500].key.coords[1], None()})
+	if count, err := store.CountMatching(&partial); assert.NoError(t, err) {
+		assert.Equal(t, 1, count)
+	}
+
+	wrong := NewPoint(Key{UInt64(1)})
+	_, err = store.Count(&wrong, nil)
+	assert.Error(t, err)
+	_, err = store.CountMatching(nil)
+	assert.Error(t, err)
+}
+
+func TestAggregate2D(t *testing.T) {
+	store, err := NewKDTree(2, STORESIZE)
+	assert.NoError(t, err)
+
+	for _, k := range [][2]uint64{{0, 10}, {5, 20}, {9, 30}, {3, 35}, {10, 40}, {2, 100}} {
+		point := NewPoint(Key{UInt64(k[0]), UInt64(k[1])})
+		assert.NoError(t, store.Put(&point, RandString()))
+	}
+
+	from := NewPoint(Key{UInt64(1), None()})
+	to := NewPoint(Key{UInt64(9), UInt64(39)})
+
+	aggregate, err := store.Aggregate(&from, &to, &AggregateOptions{Bins: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, aggregate.Count)
+	assert.Equal(t, &BoundingBox{Min: []uint64{3, 20}, Max: []uint64{9, 35}}, aggregate.Box)
+
+	// bins over [1, 9] and [10, 39] of width 3 and 10
+	assert.Equal(t, Histogram{Lower: 1, Width: 3, Counts: []int{1, 1, 1}}, aggregate.Histograms[0])
+	assert.Equal(t, Histogram{Lower: 10, Width: 10, Counts: []int{0, 1, 2}}, aggregate.Histograms[1])
+
+	empty := NewPoint(Key{UInt64(50), None()})
+	aggregate, err = store.Aggregate(&empty, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, aggregate.Count)
+	assert.Nil(t, aggregate.Box)
+	assert.Nil(t, aggregate.Histograms)
+
+	_, err = store.Aggregate(nil, nil, &AggregateOptions{Bins: -1})
+	assert.Error(t, err)
+}
+
+func TestAggregateFullSpan(t *testing.T) {
+	store, _ := NewKDTree(1, STORESIZE)
+
+	for _, v := range []uint64{0, math.MaxUint64} {
+		point := NewPoint(Key{UInt64(v)})
+		assert.NoError(t, store.Put(&point, RandString()))
+	}
+
+	aggregate, err := store.Aggregate(nil, nil, &AggregateOptions{Bins: 1})
+	if assert.NoError(t, err) {
+		assert.Equal(t, Histogram{Lower: 0, Width: math.MaxUint64, Counts: []int{2}}, aggregate.Histograms[0])
+	}
+
+	aggregate, err = store.Aggregate(nil, nil, &AggregateOptions{Bins: 2})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int{1, 1}, aggregate.Histograms[0].Counts)
+	}
+}
+
+func TestAggregateMatchesScan(t *testing.T) {
+	store, _ := NewKDTree(2, 500*STORESIZE)
+	r := rand.New(rand.NewSource(9))
+
+	keys := make([]Point, 500)
+	for i := range keys {
+		keys[i] = NewPoint(Key{UInt64(r.Uint64() % 100), UInt64(r.Uint64() % 100)})
+		assert.NoError(t, store.Put(&keys[i], RandString()))
+	}
+
+	from := NewPoint(Key{UInt64(10), UInt64(20)})
+	to := NewPoint(Key{UInt64(80), UInt64(70)})
+
+	for _, bins := range []int{0, 1, 4, 200} {
+		aggregate, err := store.Aggregate(&from, &to, &AggregateOptions{Bins: bins})
+		assert.NoError(t, err)
+
+		expected := &Aggregate{Box: &BoundingBox{Min: []uint64{100, 100}, Max: []uint64{0, 0}}}
+		if bins > 0 {
+			bounds, _ := NewRange(2, &from, &to)
+			expected.Histograms = []Histogram{store.newHistogram(0, bounds, bins), store.newHistogram(1, bounds, bins)}
+		}
+
+		for _, k := range keys {
+			x, y := k.coords[0].Value, k.coords[1].Value
+			if x < 10 || x > 80 || y < 20 || y > 70 {
+				continue
+			}
+
+			expected.Count++
+			for i, v := range []uint64{x, y} {
+				if v < expected.Box.Min[i] {
+					expected.Box.Min[i] = v
+				}
+				if v > expected.Box.Max[i] {
+					expected.Box.Max[i] = v
+				}
+				if bins > 0 {
+					h := &expected.Histograms[i]
+					h.Counts[(v-h.Lower)/h.Width]++
+				}
+			}
+		}
+
+		assert.Equal(t, expected, aggregate)
+	}
+}
+
+func TestScanWithOptions(t *testing.T) {
+	store, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
+
+	// few distinct coordinates, so that many keys are equal
+	for i := 0; i < 300; i++ {
+		point := NewPoint(Key{UInt64(uint64(10 + rand.Intn(5))), UInt64(uint64(10 + rand.Intn(5))), UInt64(uint64(10 + rand.Intn(5)))})
+		assert.NoError(t, store.Put(&point, RandString()))
+	}
+
+	center := NewPoint(Key{UInt64(12), UInt64(11), UInt64(13)})
+	from := NewPoint(Key{None(), UInt64(11), None()})
+
+	for _, options := range []ScanOptions{
+		{},
+		{Dimension: 2, Descending: true},
+		{Order: OrderByDistance, Point: &center},
+		{Order: OrderByDistance, Point: &center, Descending: true},
+	} {
+		all, err := store.ScanWithOptions(&from, nil, &options)
+		assert.NoError(t, err)
+		assert.Empty(t, all.Next)
+
+		scanned, _ := store.Scan(&from, nil)
+		assert.ElementsMatch(t, scanned, all.Values)
+
+		for i := 1; i < len(all.Keys); i++ {
+			previous := options.newEntry(&all.Keys[i-1], all.Values[i-1])
+			current := options.newEntry(&all.Keys[i], all.Values[i])
+			assert.LessOrEqual(t, options.compare(&previous, &current), 0)
+		}
+
+		// pages of 1 and of 7 add up to the whole result
+		for _, limit := range []int{1, 7} {
+			paged := ScanPage{}
+			options.Limit = limit
+			options.After = ""
+			for {
+				page, err := store.ScanWithOptions(&from, nil, &options)
+				if !assert.NoError(t, err) {
+					break
+				}
+				assert.LessOrEqual(t, len(page.Values), limit)
+				paged.Keys = append(paged.Keys, page.Keys...)
+				paged.Values = append(paged.Values, page.Values...)
+
+				if page.Next == "" {
+					break
+				}
+				options.After = page.Next
+			}
+			assert.Equal(t, all.Keys, paged.Keys)
+			assert.Equal(t, all.Values, paged.Values)
+		}
+
+		options.After = ""
+		options.Offset = 10
+		if page, err := store.ScanWithOptions(&from, nil, &options); assert.NoError(t, err) {
+			assert.Equal(t, all.Values[10:17], page.Values)
+		}
+
+		// offsets past the end and sums beyond the int range
+		options.Offset, options.Limit = len(all.Values), math.MaxInt
+		if page, err := store.ScanWithOptions(&from, nil, &options); assert.NoError(t, err) {
+			assert.Empty(t, page.Values)
+			assert.Empty(t, page.Next)
+		}
+	}
+}
+
+func TestScanWithOptionsSpreadKeys(t *testing.T) {
+	store, _ := NewKDTree(2, STORESIZE)
+	r := rand.New(rand.NewSource(21))
+
+	for i := 0; i < 2000; i++ {
+		point := NewPoint(Key{UInt64(uint64(r.Intn(1000))), UInt64(uint64(r.Intn(1000)))})
+		assert.NoError(t, store.Put(&point, RandString()))
+	}
+
+	center := NewPoint(Key{UInt64(300), UInt64(700)})
+	from := NewPoint(Key{UInt64(100), None()})
+	to := NewPoint(Key{UInt64(900), UInt64(800)})
+
+	for _, options := range []ScanOptions{
+		{Dimension: 1},
+		{Dimension: 0, Descending: true},
+		{Order: OrderByDistance, Point: &center},
+		{Order: OrderByDistance, Point: &center, Descending: true},
+	} {
+		all, err := store.ScanWithOptions(&from, &to, &options)
+		assert.NoError(t, err)
+
+		options.Offset, options.Limit = 3, 25
+		for start := 3; ; start += 25 {
+			page, err := store.ScanWithOptions(&from, &to, &options)
+			if !assert.NoError(t, err) {
+				break
+			}
+
+			end := start + 25
+			if end > len(all.Values) {
+				end = len(all.Values)
+			}
+			assert.Equal(t, all.Values[start:end], page.Values)
+
+			if page.Next == "" {
+				assert.Equal(t, len(all.Values), end)
+				break
+			}
+			options.After, options.Offset = page.Next, 0
+		}
+	}
+}
+
+func TestScanWithOptionsStablePages(t *testing.T) {
+	store, err := NewKDTree(2, STORESIZE)
+	assert.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		point := NewPoint(Key{UInt64(uint64(10 + i)), UInt64(uint64(i % 3))})
+		assert.NoError(t, store.Put(&point, RandString()))
+	}
+
+	all, err := store.ScanWithOptions(nil, nil, nil)
+	assert.NoError(t, err)
+
+	first, err := store.ScanWithOptions(nil, nil, &ScanOptions{Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, all.Values[:10], first.Values)
+
+	// changes before the cursor do not shift the next page
+	for i := 0; i < 5; i++ {
+		point := NewPoint(Key{UInt64(uint64(i)), UInt64(0)})
+		assert.NoError(t, store.Put(&point, RandString()))
+	}
+	assert.NoError(t, store.Delete(&first.Keys[3]))
+
+	second, err := store.ScanWithOptions(nil, nil, &ScanOptions{Limit: 10, After: first.Next})
+	assert.NoError(t, err)
+	assert.Equal(t, all.Values[10:20], second.Values)
+
+	_, err = store.ScanWithOptions(nil, nil, &ScanOptions{Dimension: 1, After: first.Next})
+	assert.Error(t, err)
+	_, err = store.ScanWithOptions(nil, nil, &ScanOptions{After: "invalid"})
+	assert.Error(t, err)
+	_, err = store.ScanWithOptions(nil, nil, &ScanOptions{Dimension: 2})
+	assert.Error(t, err)
+	_, err = store.ScanWithOptions(nil, nil, &ScanOptions{Order: OrderByDistance})
+	assert.Error(t, err)
+	_, err = store.ScanWithOptions(nil, nil, &ScanOptions{Limit: -1})
+	assert.Error(t, err)
+}
+
+func TestScanExclusiveBounds(t *testing.T) {
+	store, err := NewKDTree(2, STORESIZE)
+	assert.NoError(t, err)
+
+	values := make([]Value, 10)
+	for i := range values {
+		values[i] = RandString()
+		point := NewPoint(Key{UInt64(uint64(i)), UInt64(uint64(i % 2))})
+		assert.NoError(t, store.Put(&point, values[i]))
+	}
+
+	// 2 < x <= 5
+	r, err := NewRange(2, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, r.SetLower(0, 2, true))
+	assert.NoError(t, r.SetUpper(0, 5, false))
+
+	if result, err := store.ScanRange(r); assert.NoError(t, err) {
+		assert.ElementsMatch(t, values[3:6], result)
+	}
+
+	// 2 < x < 9 and y < 1
+	assert.NoError(t, r.SetUpper(0, 9, true))
+	assert.NoError(t, r.SetUpper(1, 1, true))
+
+	if result, err := store.ScanRange(r); assert.NoError(t, err) {
+		assert.ElementsMatch(t, []Value{values[4], values[6], values[8]}, result)
+	}
+	if count, err := store.CountRange(r); assert.NoError(t, err) {
+		assert.Equal(t, 3, count)
+	}
+
+	// an exclusive bound at the limits of uint64 excludes everything
+	assert.NoError(t, r.SetLower(1, math.MaxUint64, true))
+	if result, err := store.ScanRange(r); assert.NoError(t, err) {
+		assert.Empty(t, result)
+	}
+
+	assert.Error(t, r.SetLower(2, 0, true))
+	assert.Error(t, r.SetUpper(-1, 0, true))
+
+	wrong := NewPoint(Key{UInt64(1)})
+	_, err = NewRange(2, &wrong, nil)
+	assert.Error(t, err)
+
+	_, err = store.ScanRange(nil)
+	assert.Error(t, err)
+}
+
+func TestCountRangeExclusive(t *testing.T) {
+	store, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
+
+	for i := 0; i < 500; i++ {
+		point := NewPoint(Key{UInt64(uint64(rand.Intn(20))), UInt64(uint64(rand.Intn(20))), UInt64(uint64(rand.Intn(20)))})
+		assert.NoError(t, store.Put(&point, RandString()))
+	}
+
+	for i := 0; i < 100; i++ {
+		r, _ := NewRange(3, nil, nil)
+		for d := 0; d < 3; d++ {
+			assert.NoError(t, r.SetLower(d, uint64(rand.Intn(10)), rand.Intn(2) == 0))
+			assert.NoError(t, r.SetUpper(d, uint64(10+rand.Intn(10)), rand.Intn(2) == 0))
+		}
+
+		scanned, _ := store.ScanRange(r)
+		if count, err := store.CountRange(r); assert.NoError(t, err) {
+			assert.Equal(t, len(scanned), count)
+		}
+	}
+}
+
+func TestScanRegion(t *testing.T) {
+	store, err := NewKDTree(3, STORESIZE)
+	assert.NoError(t, err)
+
+	// 20 x 20 grid, the third coordinate is random
+	keys := make([]Point, 0, 400)
+	values := make([]Value, 0, 400)
+	for x := 0; x < 20; x++ {
+		for y := 0; y < 20; y++ {
+			key := NewPoint(Key{UInt64(uint64(x)), UInt64(uint64(y)), UInt64(randomUint64())})
+			keys, values = append(keys, key), append(values, RandString())
+			assert.NoError(t, store.Put(&key, values[len(values)-1]))
+		}
+	}
+
+	for _, test := range []struct {
+		region Region
+		count  int
+	}{
+		{&BoundingBox{Min: []uint64{2, 3, 0}, Max: []uint64{4, 8, math.MaxUint64}}, 18},
+		{&Ball{Center: []float64{10, 10, float64(1 << 31)}, Radius: 1 << 32}, 400},
+		{&HalfSpace{Normal: []float64{1, 1, 0}, Offset: 10}, 66},
+		// triangle with the corners (0, 0), (0, 19) and (19, 0), edges excluded
+		{&Polygon2D{X: 0, Y: 1, Vertices: [][2]float64{{-0.5, -0.5}, {-0.5, 19}, {19, -0.5}}}, 190},
+		// L shape, the notch holds x >= 10 and y >= 10
+		{&Polygon2D{X: 0, Y: 1, Vertices: [][2]float64{{-1, -1}, {20, -1}, {20, 9.5}, {9.5, 9.5}, {9.5, 20}, {-1, 20}}}, 300},
+	} {
+		result, err := store.ScanRegion(test.region)
+		assert.NoError(t, err)
+		assert.Len(t, result, test.count)
+
+		expected := make([]Value, 0)
+		for i := range keys {
+			if test.region.Contains(&keys[i]) {
+				expected = append(expected, values[i])
+			}
+		}
+		assert.ElementsMatch(t, expected, result)
+	}
+
+	_, err = store.ScanRegion(nil)
+	assert.Error(t, err)
+
+	// regions of the wrong size return an error instead of panicking
+	for _, region := range []Region{
+		&BoundingBox{Min: []uint64{2, 3}, Max: []uint64{4, 8}},
+		&Ball{Center: []float64{10, 10}, Radius: 5},
+		&HalfSpace{Normal: []float64{1}, Offset: 10},
+		&Polygon2D{X: 0, Y: 3, Vertices: [][2]float64{{0, 0}, {0, 5}, {5, 0}}},
+		&Polygon2D{X: -1, Y: 1, Vertices: [][2]float64{{0, 0}, {0, 5}, {5, 0}}},
+	} {
+		result, err := store.ScanRegion(region)
+		assert.Error(t, err)
+		assert.Empty(t, result)
+	}
+}
+
+func TestRegionIntersects(t *testing.T) {
+	box := &BoundingBox{Min: []uint64{10, 10}, Max: []uint64{12, 12}}
+
+	ball := &Ball{Center: []float64{8, 8}, Radius: 2}
+	assert.False(t, ball.Intersects(box))
+	ball.Radius = 3
+	assert.True(t, ball.Intersects(box))
+
+	half := &HalfSpace{Normal: []float64{-1, 0}, Offset: -13}
+	assert.False(t, half.Intersects(box))
+	half.Offset = -12
+	assert.True(t, half.Intersects(box))
+
+	// the box lies in the notch of the L shape
+	shape := &Polygon2D{X: 0, Y: 1, Vertices: [][2]float64{{0, 0}, {20, 0}, {20, 9}, {9, 9}, {9, 20}, {0, 20}}}
+	assert.False(t, shape.Intersects(box))
+
+	// a thin diagonal crossing the box without a vertex inside
+	diagonal := &Polygon2D{X: 0, Y: 1, Vertices: [][2]float64{{0, 0}, {1, 0}, {30, 30}}}
+	assert.True(t, diagonal.Intersects(box))
+
+	// a box within the polygon
+	assert.True(t, (&Polygon2D{X: 0, Y: 1, Vertices: [][2]float64{{0, 0}, {50, 0}, {0, 50}}}).Intersects(box))
+
+	assert.True(t, box.Intersects(&BoundingBox{Min: []uint64{12, 0}, Max: []uint64{20, 10}}))
+	assert.False(t, box.Intersects(&BoundingBox{Min: []uint64{13, 0}, Max: []uint64{20, 10}}))
+}
+
+func TestGetDistanceExtreme(t *testing.T) {
+	zero := NewPoint(Key{UInt64(0), UInt64(0)})
+	max := NewPoint(Key{UInt64(math.MaxUint64), UInt64(math.MaxUint64)})
+
+	// the squared difference needs 128 bits
+	_, distance := zero.GetDistance(&max)
+	assert.InEpsilon(t, math.Sqrt2*math.MaxUint64, distance, 1e-12)
+
+	_, squared := max.GetSquaredDistance(&zero)
+	assert.InEpsilon(t, 2*float64(math.MaxUint64)*float64(math.MaxUint64), squared, 1e-12)
+
+	near := NewPoint(Key{UInt64(1 << 40), UInt64(0)})
+	_, distance = zero.GetDistance(&near)
+	assert.Equal(t, float64(1<<40), distance)
+}
+
+func TestGetNNExtremeCoordinates(t *testing.T) {
+	keys := []Point{
+		NewPoint(Key{UInt64(0), UInt64(0)}),
+		NewPoint(Key{UInt64(math.MaxUint64), UInt64(math.MaxUint64)}),
+		NewPoint(Key{UInt64(1 << 63), UInt64(1 << 63)}),
+		NewPoint(Key{UInt64(1 << 40), UInt64(math.MaxUint64 - 1<<40)}),
+		NewPoint(Key{UInt64(math.MaxUint64 - 1<<33), UInt64(1 << 33)}),
+	}
+	values := make([]Value, len(keys))
+	for i := range values {
+		values[i] = RandString()
+	}
+
+	// each query lies closest to the key with the same index, with
+	// differences to the other keys far above 2^32
+	queries := []Point{
+		NewPoint(Key{UInt64(1 << 35), UInt64(5)}),
+		NewPoint(Key{UInt64(math.MaxUint64 - 1<<36), UInt64(math.MaxUint64)}),
+		NewPoint(Key{UInt64(1<<63 + 1<<50), UInt64(1<<63 - 1<<50)}),
+		NewPoint(Key{UInt64(0), UInt64(math.MaxUint64)}),
+		NewPoint(Key{UInt64(math.MaxUint64), UInt64(0)}),
+	}
+
+	tree, _ := NewKDTree(2, STORESIZE)
+	bucket, _ := NewBucketKDTree(2, 1)
+	arena, _ := NewArenaKDTree(2)
+	forest, _ := NewKDForest(2, nil)
+
+	stores := []interface {
+		Put(key *Point, value Value) error
+		GetKNN(key *Point, k int) ([]Value, error)
+	}{tree, bucket, arena, forest}
+
+	for _, store := range stores {
+		for i := range keys {
+			assert.NoError(t, store.Put(&keys[i], values[i]))
+		}
+
+		for i := range queries {
+			if result, err := store.GetKNN(&queries[i], 1); assert.NoError(t, err) {
+				assert.Equal(t, values[i], result[0], "query %d on %T", i, store)
+			}
+		}
+	}
+
+	for i := range queries {
+		if result, err := tree.GetNNWithOptions(&queries[i], &NNOptions{BruteForce: true}); assert.NoError(t, err) {
+			assert.Equal(t, values[i], result)
+		}
+	}
+
+	// keys 2 apart beyond 2^53, where float64 cannot tell them apart,
+	// so the distance to the splitting plane has to be exact to prune
+	close := []Point{
+		NewPoint(Key{UInt64(1<<53 + 3), UInt64(1000)}),
+		NewPoint(Key{UInt64(1<<53 + 1), UInt64(1)}),
+		NewPoint(Key{UInt64(1<<53 + 3), UInt64(0)}),
+	}
+	query := NewPoint(Key{UInt64(1<<53 + 2), UInt64(0)})
+
+	tree, _ = NewKDTree(2, STORESIZE)
+	bucket, _ = NewBucketKDTree(2, 1)
+	arena, _ = NewArenaKDTree(2)
+	forest, _ = NewKDForest(2, nil)
+
+	for _, store := range []interface {
+		Put(key *Point, value Value) error
+		GetKNN(key *Point, k int) ([]Value, error)
+	}{tree, bucket, arena, forest} {
+		for i := range close {
+			assert.NoError(t, store.Put(&close[i], values[i]))
+		}
+
+		if result, err := store.GetKNN(&query, 1); assert.NoError(t, err) {
+			assert.Equal(t, values[2], result[0], "%T", store)
+		}
+	}
+}
+
+// number of levels of the subtree
+func depthOf(n *Node) int {
+	if n == nil {
+		return 0
+	}
+
+	left, right := depthOf(n.Left), depthOf(n.Right)
+	if left > right {
+		return left + 1
+	}
+	return right + 1
+}
+
+// distances of the k nearest stored keys by brute force
+func nearestDistances(key Point, stored []KeyValuePair, k int) []float64 {
+	distances := make([]float64, len(stored))
+	for i, kv := range stored {
+		_, distances[i] = key.GetDistance(&kv.key)
+	}
+	sort.Float64s(distances)
+	return distances[:k]
+}
+
+// distances of the stored keys of values
+func distancesOf(key Point, stored []KeyValuePair, values []Value) []float64 {
+	distances := make([]float64, 0, len(values))
+	for _, v := range values {
+		for _, kv := range stored {
+			if kv.value == v {
+				_, distance := key.GetDistance(&kv.key)
+				distances = append(distances, distance)
+				break
+			}
+		}
+	}
+	return distances
+}
+
+// create values for different dimensions
+// first return value is the value to search
+// second is the nearest neighbour
+func createValues(dimensions int, keyValuePairsCount int) (KeyValuePair, KeyValuePair, []KeyValuePair) {
+
+	keyValuePairs := make([]KeyValuePair, keyValuePairsCount)
+
+	for i := 0; i < keyValuePairsCount; i++ {
+		data := RandString()
+		key := make(Key, dimensions)
+
+		for d := 0; d < dimensions; d++ {
+			key[d] = UInt64(randomUint64())
+		}
+
+		keyValuePairs[i] = KeyValuePair{key: NewPoint(key), value: data}
+	}
+
+	min := math.MaxFloat64
+
+	toSearch := keyValuePairs[0]
+	toStore := keyValuePairs[1:]
+	var nearest KeyValuePair
+
+	for _, kv := range toStore {
+		_, distance := toSearch.key.GetDistance(&kv.key)
+		if distance < min {
+			min = distance
+			nearest = kv
+		}
+	}
+
+	return toSearch, nearest, toStore
+}
+
+func randomUint64() uint64 {
+	return uint64(rand.Uint32()) // avoid overflows!!
+}
+
+func TestGetKNNLargeK(t *testing.T) {
+	tree, _ := NewKDTree(2, STORESIZE)
+	arena, _ := NewArenaKDTree(2)
+	bucket, _ := NewBucketKDTree(2, 4)
+
+	keys := []Point{
+		NewPoint(Key{UInt64(1), UInt64(1)}),
+		NewPoint(Key{UInt64(5), UInt64(5)}),
+		NewPoint(Key{UInt64(2), UInt64(2)}),
+	}
+	for i := range keys {
+		value := Value{byte(i)}
+		assert.NoError(t, tree.Put(&keys[i], value))
+		assert.NoError(t, arena.Put(&keys[i], value))
+		assert.NoError(t, bucket.Put(&keys[i], value))
+	}
+
+	// k larger than any tree must not be allocated up front
+	expected := []Value{{0}, {2}, {1}}
+	for _, knn := range []func(*Point, int) ([]Value, error){tree.GetKNN, arena.GetKNN, bucket.GetKNN} {
+		values, err := knn(&keys[0], math.MaxInt)
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, values)
+		}
+	}
+
+	values, err := tree.GetKNNWithOptions(&keys[0], math.MaxInt, &NNOptions{BruteForce: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, values)
+	}
+}
+
+func TestGetKNNPartialKey(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	keys := make([]Point, 500)
+	values := make([]Value, len(keys))
+	for i := range keys {
+		keys[i] = NewPoint(Key{UInt64(uint64(r.Intn(1000))), UInt64(uint64(r.Intn(1000))), UInt64(uint64(r.Intn(1000)))})
+		values[i] = RandString()
+	}
+
+	tree, _ := NewKDTree(3, STORESIZE)
+	bucket, _ := NewBucketKDTree(3, 8)
+	arena, _ := NewArenaKDTree(3)
+	forest, _ := NewKDForest(3, nil)
+
+	stores := []interface {
+		Put(key *Point, value Value) error
+		GetKNN(key *Point, k int) ([]Value, error)
+	}{tree, bucket, arena, forest}
+
+	keyOf := make(map[Value]*Point)
+	for i := range keys {
+		keyOf[values[i]] = &keys[i]
+	}
+
+	for _, store := range stores {
+		for i := range keys {
+			assert.NoError(t, store.Put(&keys[i], values[i]))
+		}
+
+		for q := 0; q < 50; q++ {
+			query := NewPoint(Key{UInt64(uint64(r.Intn(1000))), UInt64(uint64(r.Intn(1000))), UInt64(uint64(r.Intn(1000)))})
+			query.coords[q%3] = None()
+			if q%5 == 0 {
+				query.coords[(q+1)%3] = None()
+			}
+
+			// brute force, None axes do not add to the distance
+			expected := make([]float64, len(keys))
+			for i := range keys {
+				_, expected[i] = query.GetSquaredDistance(&keys[i])
+			}
+			sort.Float64s(expected)
+
+			result, err := store.GetKNN(&query, 5)
+			if assert.NoError(t, err) && assert.Len(t, result, 5) {
+				for i, v := range result {
+					_, distance := query.GetSquaredDistance(keyOf[v])
+					assert.Equal(t, expected[i], distance, "query %d on %T", q, store)
+				}
+			}
+		}
+
+		empty := NewPoint(Key{None(), None(), None()})
+		_, err := store.GetKNN(&empty, 1)
+		assert.Error(t, err)
+	}
+
+	empty := NewPoint(Key{None(), None(), None()})
+	_, err := tree.GetNNWithOptions(&empty, &NNOptions{BruteForce: true})
+	assert.Error(t, err)
+}
+
+func TestGetKNNFiltered(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+
+	keys := make([]Point, 1000)
+	values := make([]Value, len(keys))
+	keyOf := make(map[Value]*Point)
+	for i := range keys {
+		keys[i] = NewPoint(Key{UInt64(uint64(r.Intn(1000))), UInt64(uint64(r.Intn(10))), UInt64(uint64(r.Intn(1000)))})
+		values[i] = RandString()
+		keyOf[values[i]] = &keys[i]
+	}
+
+	tree, _ := NewKDTree(3, STORESIZE)
+	forest, _ := NewKDForest(3, nil)
+	for i := range keys {
+		assert.NoError(t, tree.Put(&keys[i], values[i]))
+		assert.NoError(t, forest.Put(&keys[i], values[i]))
+	}
+
+	filter := NewPoint(Key{None(), UInt64(3), None()})
+	odd := func(key *Point, value Value) bool { return key.coords[0].Value%2 == 1 }
+
+	optionsList := []*NNOptions{
+		{Filter: &filter},
+		{Accept: odd},
+		{Filter: &filter, Accept: odd},
+		{Filter: &filter, Accept: odd, BruteForce: true},
+	}
+
+	for i, options := range optionsList {
+		for q := 0; q < 20; q++ {
+			query := NewPoint(Key{UInt64(uint64(r.Intn(1000))), UInt64(uint64(r.Intn(10))), UInt64(uint64(r.Intn(1000)))})
+
+			// brute force over the entries passing the filters
+			expected := make([]float64, 0)
+			for j := range keys {
+				if (options.Filter == nil || keys[j].IsPartiallyEqual(options.Filter)) &&
+					(options.Accept == nil || options.Accept(&keys[j], values[j])) {
+					_, distance := query.GetSquaredDistance(&keys[j])
+					expected = append(expected, distance)
+				}
+			}
+			sort.Float64s(expected)
+
+			for _, store := range []interface {
+				GetKNNWithOptions(key *Point, k int, options *NNOptions) ([]Value, error)
+			}{tree, forest} {
+				result, err := store.GetKNNWithOptions(&query, 5, options)
+				if assert.NoError(t, err) && assert.Len(t, result, 5) {
+					for j, v := range result {
+						assert.True(t, options.accepts(keyOf[v], v))
+						_, distance := query.GetSquaredDistance(keyOf[v])
+						assert.Equal(t, expected[j], distance, "options %d on %T", i, store)
+					}
+				}
+			}
+		}
+	}
+
+	// no key matches
+	none := NewPoint(Key{None(), UInt64(10), None()})
+	_, err := tree.GetNNWithOptions(&keys[0], &NNOptions{Filter: &none})
+	assert.Error(t, err)
+	_, err = forest.GetNNWithOptions(&keys[0], &NNOptions{Filter: &none})
+	assert.Error(t, err)
+
+	result, err := tree.GetKNNWithOptions(&keys[0], 5, &NNOptions{Accept: func(*Point, Value) bool { return false }})
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+
+	wrongSize := NewPoint(Key{None(), UInt64(3)})
+	_, err = tree.GetNNWithOptions(&keys[0], &NNOptions{Filter: &wrongSize})
+	assert.Error(t, err)
+}
+
+func TestGetFarthestAndReverseNN(t *testing.T) {
+	r := rand.New(rand.NewSource(11))
+
+	tree, _ := NewKDTree(2, STORESIZE)
+
+	keys := make([]Point, 400)
+	values := make([]Value, len(keys))
+	for i := range keys {
+		// duplicates are common
+		keys[i] = NewPoint(Key{UInt64(uint64(r.Intn(100))), UInt64(uint64(r.Intn(100)))})
+		values[i] = RandString()
+		assert.NoError(t, tree.Put(&keys[i], values[i]))
+	}
+
+	// the first keys are deleted, the statistics still cover them
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, tree.Delete(&keys[i]))
+	}
+	keys, values = keys[50:], values[50:]
+
+	for q := 0; q < 30; q++ {
+		query := NewPoint(Key{UInt64(uint64(r.Intn(120))), UInt64(uint64(r.Intn(120)))})
+
+		max := 0.0
+		for i := range keys {
+			if _, distance := query.GetSquaredDistance(&keys[i]); distance > max {
+				max = distance
+			}
+		}
+
+		if farthest, err := tree.GetFarthest(&query); assert.NoError(t, err) {
+			found := false
+			for i := range keys {
+				_, distance := query.GetSquaredDistance(&keys[i])
+				found = found || (values[i] == farthest && distance == max)
+			}
+			assert.True(t, found, "query %d", q)
+		}
+
+		expected := make([]Value, 0)
+		for i := range keys {
+			_, distance := query.GetSquaredDistance(&keys[i])
+			nearest := math.MaxFloat64
+			for j := range keys {
+				if _, other := keys[i].GetSquaredDistance(&keys[j]); i != j && other < nearest {
+					nearest = other
+				}
+			}
+			if distance <= nearest {
+				expected = append(expected, values[i])
+			}
+		}
+
+		if result, err := tree.GetReverseNN(&query); assert.NoError(t, err) {
+			assert.ElementsMatch(t, expected, result, "query %d", q)
+		}
+	}
+
+	partial := NewPoint(Key{UInt64(3), None()})
+	_, err := tree.GetReverseNN(&partial)
+	assert.Error(t, err)
+
+	empty, _ := NewKDTree(2, STORESIZE)
+	_, err = empty.GetFarthest(&keys[0])
+	assert.Error(t, err)
+	_, err = empty.GetReverseNN(&keys[0])
+	assert.Error(t, err)
+}
+
+func TestJoin(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+
+	left, _ := NewKDTree(2, STORESIZE)
+	right, _ := NewKDTree(2, STORESIZE)
+
+	leftKeys, rightKeys := make([]Point, 2000), make([]Point, 200)
+	keyOf := make(map[Value]*Point)
+
+	for _, side := range []struct {
+		tree *KDTree
+		keys []Point
+	}{{left, leftKeys}, {right, rightKeys}} {
+		for i := range side.keys {
+			side.keys[i] = NewPoint(Key{UInt64(uint64(r.Intn(200))), UInt64(uint64(r.Intn(200)))})
+			value := RandString()
+			keyOf[value] = &side.keys[i]
+			assert.NoError(t, side.tree.Put(&side.keys[i], value))
+		}
+	}
+
+	for _, distance := range []float64{0, 5, 12.5, 40} {
+		expected := 0
+		for i := range leftKeys {
+			for j := range rightKeys {
+				if _, d := leftKeys[i].GetDistance(&rightKeys[j]); d <= distance {
+					expected++
+				}
+			}
+		}
+
+		pairs, err := JoinWithinDistance(left, right, distance)
+		if assert.NoError(t, err) && assert.Len(t, pairs, expected, "distance %f", distance) {
+			seen := make(map[JoinPair]bool)
+			for _, p := range pairs {
+				_, d := keyOf[p.Left].GetDistance(keyOf[p.Right])
+				assert.LessOrEqual(t, d, distance)
+				assert.Equal(t, d, p.Distance)
+				assert.False(t, seen[p])
+				seen[p] = true
+			}
+		}
+	}
+
+	pairs, err := JoinNearest(left, right)
+	if assert.NoError(t, err) && assert.Len(t, pairs, len(leftKeys)) {
+		for _, p := range pairs {
+			key := keyOf[p.Left]
+			nearest := math.MaxFloat64
+			for j := range rightKeys {
+				if _, d := key.GetDistance(&rightKeys[j]); d < nearest {
+					nearest = d
+				}
+			}
+			assert.Equal(t, nearest, p.Distance)
+			_, d := key.GetDistance(keyOf[p.Right])
+			assert.Equal(t, nearest, d)
+		}
+	}
+
+	empty, _ := NewKDTree(2, STORESIZE)
+	_, err = JoinNearest(left, empty)
+	assert.Error(t, err)
+	if pairs, err := JoinNearest(empty, right); assert.NoError(t, err) {
+		assert.Empty(t, pairs)
+	}
+
+	other, _ := NewKDTree(3, STORESIZE)
+	_, err = JoinWithinDistance(left, other, 1)
+	assert.Error(t, err)
+}
+
+func TestNodeBoxes(t *testing.T) {
+	tree, _ := NewKDTree(2, STORESIZE)
+
+	keys := []Point{
+		NewPoint(Key{UInt64(50), UInt64(50)}),
+		NewPoint(Key{UInt64(10), UInt64(90)}),
+		NewPoint(Key{UInt64(80), UInt64(20)}),
+		NewPoint(Key{UInt64(30), UInt64(5)}),
+		NewPoint(Key{UInt64(95), UInt64(70)}),
+		NewPoint(Key{UInt64(60), UInt64(60)}),
+	}
+	for i := range keys {
+		assert.NoError(t, tree.Put(&keys[i], RandString()))
+	}
+
+	assert.Equal(t, []uint64{10, 5}, tree.root.box.Min)
+	assert.Equal(t, []uint64{95, 90}, tree.root.box.Max)
+
+	// the boxes shrink on delete, also when the root is replaced
+	assert.NoError(t, tree.Delete(&keys[4]))
+	assert.NoError(t, tree.Delete(&keys[0]))
+	assert.NoError(t, tree.Delete(&keys[3]))
+	assert.NoError(t, tree.Validate())
+
+	assert.Equal(t, []uint64{10, 20}, tree.root.box.Min)
+	assert.Equal(t, []uint64{80, 90}, tree.root.box.Max)
+
+	built, err := BuildKDTree(2, STORESIZE, keys, make([]Value, len(keys)), nil)
+	if assert.NoError(t, err) {
+		assert.NoError(t, built.Validate())
+		assert.Equal(t, []uint64{10, 5}, built.root.box.Min)
+		assert.Equal(t, []uint64{95, 90}, built.root.box.Max)
+	}
+}
+
+func TestStats(t *testing.T) {
+	tree, _ := NewKDTree(2, STORESIZE)
+
+	empty := tree.Stats()
+	assert.Equal(t, 0, empty.Count)
+	assert.Equal(t, 0, empty.MaxDepth)
+	assert.Nil(t, empty.Min)
+	assert.Equal(t, tree.size, empty.ByteSize)
+	assert.Equal(t, uint64(STORESIZE), empty.MaxSize)
+	assert.Equal(t, 0, tree.GetNodesCount())
+
+	keys := []Point{
+		NewPoint(Key{UInt64(50), UInt64(50)}),
+		NewPoint(Key{UInt64(10), UInt64(90)}),
+		NewPoint(Key{UInt64(80), UInt64(20)}),
+		NewPoint(Key{UInt64(50), UInt64(50)}),
+	}
+	for i := range keys {
+		assert.NoError(t, tree.Put(&keys[i], RandString()))
+	}
+
+	stats := tree.Stats()
+	assert.Equal(t, 4, stats.Count)
+	assert.Equal(t, 4, stats.Nodes)
+	assert.Equal(t, 3, stats.MaxDepth)
+	assert.Equal(t, 2.0, stats.AverageDepth)
+	assert.Equal(t, 1, stats.Duplicates)
+	assert.Equal(t, []uint64{10, 20}, stats.Min)
+	assert.Equal(t, []uint64{80, 90}, stats.Max)
+	assert.Equal(t, tree.size, stats.ByteSize)
+	assert.Equal(t, 4, tree.GetNodesCount())
+
+	bucket, _ := NewBucketKDTree(2, 4)
+	assert.Equal(t, 0, bucket.Stats().Count)
+	for i := range keys {
+		assert.NoError(t, bucket.Put(&keys[i], RandString()))
+	}
+	assert.Equal(t, 1, bucket.Stats().Duplicates)
+	assert.Equal(t, stats.Max, bucket.Stats().Max)
+}
+
+func TestInstrumentedStore(t *testing.T) {
+	tree, _ := NewKDTree(2, STORESIZE)
+	store, err := NewInstrumentedStore(tree)
+	assert.NoError(t, err)
+
+	_, err = NewInstrumentedStore(nil)
+	assert.Error(t, err)
+
+	point1 := NewPoint(Key{UInt64(1), UInt64(2)})
+	point2 := NewPoint(Key{UInt64(3), UInt64(4)})
+	wrong := NewPoint(Key{UInt64(1)})
+
+	assert.NoError(t, store.Put(&point1, RandString()))
+	assert.NoError(t, store.Put(&point2, RandString()))
+	assert.Error(t, store.Put(&wrong, RandString()))
+	_, err = store.GetNN(&point1)
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	store.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, body, "# TYPE kvstore_operations_total counter\n")
+	assert.Contains(t, body, `kvstore_operations_total{operation="put"} 3`+"\n")
+	assert.Contains(t, body, `kvstore_operation_errors_total{operation="put"} 1`+"\n")
+	assert.Contains(t, body, `kvstore_operations_total{operation="get_nn"} 1`+"\n")
+	assert.Contains(t, body, `kvstore_operation_duration_seconds_bucket{operation="put",le="+Inf"} 3`+"\n")
+	assert.Contains(t, body, `kvstore_operation_duration_seconds_count{operation="delete"} 0`+"\n")
+	assert.Contains(t, body, "kvstore_keys 2\n")
+	assert.Contains(t, body, "kvstore_max_depth 2\n")
+
+	// the gauges are kept up to date instead of walking the tree
+	r := rand.New(rand.NewSource(5))
+	keys := make([]Point, 500)
+	values := make([]Value, len(keys))
+	for i := range keys {
+		keys[i] = NewPoint(Key{UInt64(r.Uint64() % 100), UInt64(r.Uint64() % 100)})
+		values[i] = RandString()
+	}
+
+	built, err := BuildKDTree(2, 1000*STORESIZE, keys, values, nil)
+	assert.NoError(t, err)
+
+	for i := range keys {
+		assert.NoError(t, tree.Put(&keys[i], values[i]))
+	}
+	for i := 0; i < len(keys); i += 3 {
+		assert.NoError(t, tree.Delete(&keys[i]))
+		assert.NoError(t, built.Delete(&keys[i]))
+	}
+
+	for _, tree := range []*KDTree{tree, built} {
+		assert.NoError(t, tree.Validate())
+
+		stats, gauges := tree.Stats(), tree.gauges()
+		assert.Equal(t, stats.Count, gauges.keys)
+		assert.Equal(t, stats.MaxDepth, gauges.maxDepth)
+		assert.InDelta(t, stats.AverageDepth, gauges.averageDepth, 1e-9)
+		assert.Equal(t, stats.ByteSize, gauges.byteSize)
+	}
+}
+
+func TestQueryTrace(t *testing.T) {
+	tree, _ := NewKDTree(2, 1000*STORESIZE)
+	r := rand.New(rand.NewSource(3))
+
+	keys := make([]Point, 1000)
+	for i := range keys {
+		keys[i] = NewPoint(Key{UInt64(r.Uint64() % 10000), UInt64(r.Uint64() % 10000)})
+		assert.NoError(t, tree.Put(&keys[i], RandString()))
+	}
+	maxDepth := tree.Stats().MaxDepth
+
+	values, trace, err := tree.GetTraced(&keys[500])
+	if assert.NoError(t, err) {
+		expected, _ := tree.Get(&keys[500])
+		assert.Equal(t, expected, values)
+		assert.Equal(t, trace.MaxDepth, trace.VisitedNodes)
+		assert.Equal(t, 0, trace.Distances)
+	}
+
+	partial := NewPoint(Key{keys[3].coords[0], None()})
+	values, trace, _ = tree.GetTraced(&partial)
+	expected, _ := tree.Get(&partial)
+	assert.Equal(t, expected, values)
+	assert.Less(t, trace.VisitedNodes, len(keys))
+	assert.Greater(t, trace.PrunedBranches, 0)
+
+	all := NewPoint(Key{None(), None()})
+	values, trace, _ = tree.ScanTraced(&all, &all)
+	assert.Len(t, values, len(keys))
+	assert.Equal(t, len(keys), trace.VisitedNodes)
+	assert.Equal(t, maxDepth, trace.MaxDepth)
+	assert.Equal(t, 0, trace.PrunedBranches)
+
+	from := NewPoint(Key{UInt64(1000), UInt64(1000)})
+	to := NewPoint(Key{UInt64(2000), UInt64(2000)})
+	values, trace, _ = tree.ScanTraced(&from, &to)
+	expected, _ = tree.Scan(&from, &to)
+	assert.Equal(t, expected, values)
+	assert.Less(t, trace.VisitedNodes, len(keys))
+	assert.Greater(t, trace.PrunedBranches, 0)
+
+	query := NewPoint(Key{UInt64(5000), UInt64(5000)})
+	value, trace, err := tree.GetNNTraced(&query, nil)
+	if assert.NoError(t, err) {
+		expected, _ := tree.GetNN(&query)
+		assert.Equal(t, expected, value)
+		assert.Equal(t, trace.VisitedNodes, trace.Distances)
+		assert.Less(t, trace.VisitedNodes, len(keys))
+		assert.Greater(t, trace.PrunedBranches, 0)
+		assert.LessOrEqual(t, trace.MaxDepth, maxDepth)
+	}
+
+	_, _, err = tree.GetNNTraced(&query, &NNOptions{BruteForce: true})
+	assert.Error(t, err)
+}
+
+func TestExport(t *testing.T) {
+	tree, _ := NewKDTree(2, STORESIZE)
+
+	var out strings.Builder
+	assert.NoError(t, tree.PrettyPrint(&out))
+	assert.Equal(t, "(empty)\n", out.String())
+
+	keys := []Point{
+		NewPoint(Key{UInt64(50), UInt64(50)}),
+		NewPoint(Key{UInt64(10), UInt64(90)}),
+		NewPoint(Key{UInt64(80), UInt64(20)}),
+		NewPoint(Key{UInt64(60), UInt64(30)}),
+	}
+	for i := range keys {
+		assert.NoError(t, tree.Put(&keys[i], Value{byte(i)}))
+	}
+
+	out.Reset()
+	assert.NoError(t, tree.PrettyPrint(&out))
+	assert.Equal(t, "(50, 50) axis 0 count 4\n"+
+		"L (10, 90) axis 1 count 1\n"+
+		"R (80, 20) axis 1 count 2\n"+
+		"  R (60, 30) axis 0 count 1\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, tree.WriteDOT(&out))
+	assert.Contains(t, out.String(), "n0 [label=\"(50, 50)\\naxis 0, count 4\"];\n")
+	assert.Contains(t, out.String(), "n0 -> n1 [label=\"< 50\"];\n")
+	assert.Contains(t, out.String(), "n2 -> n3 [label=\">= 20\"];\n")
+
+	out.Reset()
+	assert.NoError(t, tree.WriteJSON(&out))
+
+	var root jsonNode
+	if assert.NoError(t, json.Unmarshal([]byte(out.String()), &root)) {
+		assert.Equal(t, []uint64{50, 50}, root.Key)
+		assert.Equal(t, []uint64{10, 20}, root.Min)
+		assert.Equal(t, []uint64{60, 30}, root.Right.Right.Key)
+		assert.Equal(t, "03000000000000000000", root.Right.Right.Value)
+		assert.Nil(t, root.Right.Left)
+	}
 }
@@ -0,0 +1,267 @@
+/**
+metrics.go
+Instrumentation of a KVStore, exposed in the Prometheus text format
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// upper bounds of the latency histogram buckets in seconds
+var latencyBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// operations in the order they are written
+var instrumentedOperations = []string{"put", "get", "delete", "scan", "get_nn", "upsert"}
+
+// the shape of a store written as gauges
+type storeGauges struct {
+	keys         int
+	nodes        int
+	maxDepth     int // the root has depth 1
+	averageDepth float64
+	byteSize     uint64
+	maxSize      uint64
+}
+
+// implemented by stores which know their gauges without walking the tree,
+// the gauges of other stores are taken from Stats
+type gaugedStore interface {
+	gauges() storeGauges
+}
+
+func readGauges(store KVStore) storeGauges {
+
+	if g, ok := store.(gaugedStore); ok {
+		return g.gauges()
+	}
+
+	stats := store.Stats()
+
+	return storeGauges{
+		keys:         stats.Count,
+		nodes:        stats.Nodes,
+		maxDepth:     stats.MaxDepth,
+		averageDepth: stats.AverageDepth,
+		byteSize:     stats.ByteSize,
+		maxSize:      stats.MaxSize,
+	}
+}
+
+type operationMetrics struct {
+	count   uint64
+	errors  uint64
+	buckets []uint64 // per bucket, the last one without upper bound
+	seconds float64  // summed latency
+}
+
+// InstrumentedStore counts the operations on a store, their errors and
+// latencies. Operations and writing the metrics hold the same mutex, so
+// the store is used by one goroutine at a time and a scrape waits for
+// the running operation, as operations wait for the scrape.
+type InstrumentedStore struct {
+	store      KVStore
+	mutex      sync.Mutex
+	operations map[string]*operationMetrics
+}
+
+func NewInstrumentedStore(store KVStore) (*InstrumentedStore, error) {
+
+	if store == nil {
+		return nil, errors.New("store cannot be nil")
+	}
+
+	s := &InstrumentedStore{store: store, operations: make(map[string]*operationMetrics)}
+	for _, op := range instrumentedOperations {
+		s.operations[op] = &operationMetrics{buckets: make([]uint64, len(latencyBuckets)+1)}
+	}
+
+	return s, nil
+}
+
+// records an operation which started at start
+func (s *InstrumentedStore) observe(op string, start time.Time, err error) {
+
+	seconds := time.Since(start).Seconds()
+	m := s.operations[op]
+
+	m.count++
+	m.seconds += seconds
+	m.buckets[sort.SearchFloat64s(latencyBuckets, seconds)]++
+
+	if err != nil {
+		m.errors++
+	}
+}
+
+func (s *InstrumentedStore) Put(key *Point, value Value) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	start := time.Now()
+	err := s.store.Put(key, value)
+	s.observe("put", start, err)
+
+	return err
+}
+
+func (s *InstrumentedStore) Get(key *Point) ([]Value, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	start := time.Now()
+	values, err := s.store.Get(key)
+	s.observe("get", start, err)
+
+	return values, err
+}
+
+func (s *InstrumentedStore) Delete(key *Point) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	start := time.Now()
+	err := s.store.Delete(key)
+	s.observe("delete", start, err)
+
+	return err
+}
+
+func (s *InstrumentedStore) Scan(from *Point, to *Point) ([]Value, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	start := time.Now()
+	values, err := s.store.Scan(from, to)
+	s.observe("scan", start, err)
+
+	return values, err
+}
+
+func (s *InstrumentedStore) GetNN(key *Point) (Value, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	start := time.Now()
+	value, err := s.store.GetNN(key)
+	s.observe("get_nn", start, err)
+
+	return value, err
+}
+
+func (s *InstrumentedStore) Upsert(key *Point, value Value) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	start := time.Now()
+	err := s.store.Upsert(key, value)
+	s.observe("upsert", start, err)
+
+	return err
+}
+
+// not counted as an operation, the metrics themselves are read from it
+func (s *InstrumentedStore) Stats() *TreeStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.store.Stats()
+}
+
+// writes all metrics in the Prometheus text format
+func (s *InstrumentedStore) WriteMetrics(w io.Writer) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p := &metricsPrinter{w: w}
+
+	p.header("kvstore_operations_total", "counter", "Operations on the store.")
+	for _, op := range instrumentedOperations {
+		p.sample("kvstore_operations_total", operationLabel(op), float64(s.operations[op].count))
+	}
+
+	p.header("kvstore_operation_errors_total", "counter", "Operations on the store which returned an error.")
+	for _, op := range instrumentedOperations {
+		p.sample("kvstore_operation_errors_total", operationLabel(op), float64(s.operations[op].errors))
+	}
+
+	p.header("kvstore_operation_duration_seconds", "histogram", "Latency of the operations on the store.")
+	for _, op := range instrumentedOperations {
+		m := s.operations[op]
+
+		// the buckets of the format are cumulative
+		cumulative := uint64(0)
+		for i, count := range m.buckets {
+			cumulative += count
+
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = formatFloat(latencyBuckets[i])
+			}
+			p.sample("kvstore_operation_duration_seconds_bucket", operationLabel(op)+`,le="`+le+`"`, float64(cumulative))
+		}
+
+		p.sample("kvstore_operation_duration_seconds_sum", operationLabel(op), m.seconds)
+		p.sample("kvstore_operation_duration_seconds_count", operationLabel(op), float64(m.count))
+	}
+
+	g := readGauges(s.store)
+
+	p.gauge("kvstore_keys", "Keys in the store.", float64(g.keys))
+	p.gauge("kvstore_nodes", "Nodes of the tree.", float64(g.nodes))
+	p.gauge("kvstore_max_depth", "Depth of the deepest key, the root has depth 1.", float64(g.maxDepth))
+	p.gauge("kvstore_average_depth", "Average depth of the keys.", g.averageDepth)
+	p.gauge("kvstore_size_bytes", "Bytes used by the store.", float64(g.byteSize))
+	p.gauge("kvstore_max_size_bytes", "Bytes the store may use.", float64(g.maxSize))
+
+	return p.err
+}
+
+// serves the metrics to a Prometheus scraper
+func (s *InstrumentedStore) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.WriteMetrics(w)
+	})
+}
+
+// writes lines until the first error
+type metricsPrinter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *metricsPrinter) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func (p *metricsPrinter) header(name string, kind string, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (p *metricsPrinter) sample(name string, labels string, value float64) {
+	p.printf("%s{%s} %s\n", name, labels, formatFloat(value))
+}
+
+func (p *metricsPrinter) gauge(name string, help string, value float64) {
+	p.header(name, "gauge", help)
+	p.printf("%s %s\n", name, formatFloat(value))
+}
+
+func operationLabel(op string) string {
+	return `operation="` + op + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
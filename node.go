@@ -7,6 +7,9 @@ import (
 type Node struct {
 	Key   Point
 	value Value
+	axis  int         // split axis, chosen on insertion
+	count int         // nodes in the subtree, including this one
+	box   BoundingBox // bounds the keys of the subtree
 
 	Left  *Node
 	Right *Node
@@ -18,7 +21,52 @@ func NewNode(key *Point, value Value) (error, *Node) {
 		return errors.New("cannot store partial point"), nil
 	}
 
-	return nil, &Node{Key: *key, value: value, Left: nil, Right: nil}
+	// both bounds share one array
+	bounds := make([]uint64, 2*key.GetSize())
+	box := BoundingBox{Min: bounds[:key.GetSize():key.GetSize()], Max: bounds[key.GetSize():]}
+	for i, k := range key.coords {
+		box.Min[i], box.Max[i] = k.Value, k.Value
+	}
+
+	return nil, &Node{Key: *key, value: value, count: 1, box: box, Left: nil, Right: nil}
+}
+
+// extends the box of the subtree by key
+func (n *Node) extendBox(key *Point) {
+	for i, k := range key.coords {
+		if k.Value < n.box.Min[i] {
+			n.box.Min[i] = k.Value
+		}
+		if k.Value > n.box.Max[i] {
+			n.box.Max[i] = k.Value
+		}
+	}
+}
+
+// recomputes the box from the key and the boxes of the children
+func (n *Node) updateBox() {
+	n.computeBox(&n.box)
+}
+
+// writes the bounds of the key and the boxes of the children into box
+func (n *Node) computeBox(box *BoundingBox) {
+	for i, k := range n.Key.coords {
+		box.Min[i], box.Max[i] = k.Value, k.Value
+	}
+
+	for _, child := range []*Node{n.Left, n.Right} {
+		if child == nil {
+			continue
+		}
+		for i := range box.Min {
+			if child.box.Min[i] < box.Min[i] {
+				box.Min[i] = child.box.Min[i]
+			}
+			if child.box.Max[i] > box.Max[i] {
+				box.Max[i] = child.box.Max[i]
+			}
+		}
+	}
 }
 
 func (n *Node) SetValue(value Value) {
@@ -26,10 +74,8 @@ func (n *Node) SetValue(value Value) {
 }
 
 func (n *Node) IsLeftChild(nc *Node) bool {
-	if n.Left == nil {
-		return false
-	}
-	return nc.Key.IsEqual(&n.Left.Key)
+	// compare identities, keys may be stored more than once
+	return n.Left != nil && n.Left == nc
 }
 
 func (n *Node) IsLeaf() bool {
@@ -48,8 +94,25 @@ func (n *Node) KeyValueAt(i int) uint64 {
 	return v.Value
 }
 
+func (n *Node) GetAxis() int {
+	return n.axis
+}
+
+// coordinate on the split axis
+func (n *Node) SplitValue() uint64 {
+	return n.KeyValueAt(n.axis)
+}
+
+// number of nodes in the subtree, 0 for a nil node
+func (n *Node) GetCount() int {
+	if n == nil {
+		return 0
+	}
+	return n.count
+}
+
 func (n *Node) GetByteSize() uint64 {
-	return n.Key.GetByteSize() + 10 + 8 + 8
+	return n.Key.GetByteSize() + 10 + 8 + 8 + 8 + 8 + 2*24 + 2*8*uint64(n.Key.GetSize())
 }
 
 func (n *Node) SmallerThan(otherNode *Node, keyIndexToCompare int) bool {
@@ -0,0 +1,473 @@
+/**
+parallel.go
+Parallel bulk build and parallel query execution of the KDTree
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+type BuildOptions struct {
+	// maximal number of goroutines partitioning at the same
+	// time, runtime.GOMAXPROCS(0) if 0, sequential if 1
+	Workers int
+
+	// chooses the split axis of every node from the keys of its
+	// subtree and is kept as strategy for later puts
+	Strategy SplitStrategy
+}
+
+// builds a balanced tree from all keys at once. Every node splits its
+// keys at the median of its split axis, so the tree has logarithmic depth.
+// Subtrees are partitioned concurrently as long as workers are free.
+// Equal keys keep their order, so exact key operations act on the
+// earliest of them, as if the keys were put one after the other.
+func BuildKDTree(keySize int, maxSize uint64, keys []Point, values []Value, options *BuildOptions) (*KDTree, error) {
+
+	if options == nil {
+		options = &BuildOptions{}
+	}
+
+	if len(keys) != len(values) {
+		return nil, errors.New("keys and values have different lengths")
+	}
+
+	if options.Workers < 0 {
+		return nil, errors.New("Workers cannot be negative")
+	}
+
+	t, err := NewKDTreeWithStrategy(keySize, maxSize, options.Strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]buildEntry, len(keys))
+	for i := range keys {
+		if keys[i].GetSize() != keySize {
+			return nil, errors.New("Key and Tree have different sizes!")
+		}
+
+		err, node := NewNode(&keys[i], values[i])
+		if err != nil {
+			return nil, err
+		}
+
+		entries[i] = buildEntry{node: node, order: i}
+		t.stats.add(&keys[i])
+		t.size += node.GetByteSize()
+	}
+
+	workers := options.Workers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	t.root = t.buildSubtree(entries, 0, make(chan struct{}, workers-1))
+	t.countDepths(t.root, 0)
+
+	return t, nil
+}
+
+// input position of a node, which orders nodes with equal
+// coordinates, so that the earliest of equal keys is found first
+type buildEntry struct {
+	node  *Node
+	order int
+}
+
+// links the nodes of entries into a subtree and returns its
+// root. tokens limit the number of additional goroutines.
+func (t *KDTree) buildSubtree(entries []buildEntry, depth int, tokens chan struct{}) *Node {
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	axis := t.chooseBuildAxis(entries, depth)
+
+	median := len(entries) / 2
+	selectEntry(entries, median, axis)
+	split := entries[median].node.KeyValueAt(axis)
+
+	// smaller entries with the same coordinate have to go right as well,
+	// they are moved next to the median and the earliest becomes the root
+	first := median
+	for i := median - 1; i >= 0; i-- {
+		if entries[i].node.KeyValueAt(axis) == split {
+			first--
+			entries[i], entries[first] = entries[first], entries[i]
+		}
+	}
+
+	for i := first + 1; i <= median; i++ {
+		if entries[i].order < entries[first].order {
+			entries[i], entries[first] = entries[first], entries[i]
+		}
+	}
+
+	root := entries[first].node
+	root.axis = axis
+
+	// a goroutine does not pay off for small subtrees
+	if len(entries) < 1024 {
+		root.Left = t.buildSubtree(entries[:first], depth+1, tokens)
+		root.Right = t.buildSubtree(entries[first+1:], depth+1, tokens)
+		root.count = len(entries)
+		root.updateBox()
+		return root
+	}
+
+	forkJoin(tokens,
+		func() { root.Left = t.buildSubtree(entries[:first], depth+1, tokens) },
+		func() { root.Right = t.buildSubtree(entries[first+1:], depth+1, tokens) })
+
+	root.count = len(entries)
+	root.updateBox()
+
+	return root
+}
+
+func entryLess(a buildEntry, b buildEntry, axis int) bool {
+	av, bv := a.node.KeyValueAt(axis), b.node.KeyValueAt(axis)
+	return av < bv || (av == bv && a.order < b.order)
+}
+
+// quickselect, moves the k-th smallest entry to position k with
+// all smaller entries before and all greater entries after it
+func selectEntry(entries []buildEntry, k int, axis int) {
+
+	lo, hi := 0, len(entries)-1
+
+	for lo < hi {
+
+		// median of three as pivot, moved to hi
+		mid := lo + (hi-lo)/2
+		if entryLess(entries[mid], entries[lo], axis) {
+			entries[mid], entries[lo] = entries[lo], entries[mid]
+		}
+		if entryLess(entries[hi], entries[lo], axis) {
+			entries[hi], entries[lo] = entries[lo], entries[hi]
+		}
+		if entryLess(entries[mid], entries[hi], axis) {
+			entries[mid], entries[hi] = entries[hi], entries[mid]
+		}
+
+		pivot := entries[hi]
+		store := lo
+		for i := lo; i < hi; i++ {
+			if entryLess(entries[i], pivot, axis) {
+				entries[i], entries[store] = entries[store], entries[i]
+				store++
+			}
+		}
+		entries[store], entries[hi] = entries[hi], entries[store]
+
+		if k == store {
+			return
+		} else if k < store {
+			hi = store - 1
+		} else {
+			lo = store + 1
+		}
+	}
+}
+
+// like chooseAxis, but on the keys of the subtree instead of estimates
+func (t *KDTree) chooseBuildAxis(entries []buildEntry, depth int) int {
+
+	if t.strategy == RoundRobin {
+		return depth % t.kSize
+	}
+
+	stats := newKeyStatistics(t.kSize)
+	for _, e := range entries {
+		stats.add(&e.node.Key)
+	}
+
+	best := depth % t.kSize
+	bestScore := -1.0
+
+	for i := 0; i < t.kSize; i++ {
+		axis := (depth + i) % t.kSize
+
+		score := float64(stats.max[axis] - stats.min[axis])
+		if t.strategy == MaxVariance {
+			score = stats.variance(axis)
+		}
+
+		if score > bestScore {
+			best = axis
+			bestScore = score
+		}
+	}
+
+	return best
+}
+
+// sets the maximal number of goroutines running a Scan, a partial Get
+// or a brute force nearest neighbour search, 1 runs them sequentially.
+// Queries may run concurrently with each other but not with writes.
+func (t *KDTree) SetWorkers(workers int) error {
+
+	if workers < 1 {
+		return errors.New("workers has to be at least 1")
+	}
+
+	t.workers = workers
+	return nil
+}
+
+// subtrees this far below the root are searched in their own
+// goroutine if a worker is free, deeper ones are too small
+func (t *KDTree) forkDepth() int {
+	depth := 2
+	for w := t.workers; w > 1; w /= 2 {
+		depth++
+	}
+	return depth
+}
+
+func (t *KDTree) parallelScanQuery(node *Node, r *Range, depth int, tokens chan struct{}) []*Node {
+
+	// whole or pruned subtrees are not worth a goroutine
+	if node == nil || depth >= t.forkDepth() || !node.box.intersectsRange(r) || node.box.isWithinRange(r) {
+		return t.scanQuery(node, r, depth+1, nil)
+	}
+
+	visitLeft, visitRight := scanBranches(node, r)
+
+	var left, right []*Node
+
+	forkJoin(tokens,
+		func() {
+			if visitLeft {
+				left = t.parallelScanQuery(node.Left, r, depth+1, tokens)
+			}
+		},
+		func() {
+			if visitRight {
+				right = t.parallelScanQuery(node.Right, r, depth+1, tokens)
+			}
+		})
+
+	// same order as scanQuery
+	nodes := append(left, right...)
+	if node.Key.IsWithin(r) {
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+func (t *KDTree) parallelPartialSearchQuery(key *Point, node *Node, depth int, tokens chan struct{}) []*Node {
+
+	if node == nil || depth >= t.forkDepth() {
+		return t.partialSearchQuery(key, node, depth+1, nil)
+	}
+
+	_, kv := key.GetKeyAt(node.axis)
+	nodeKeyValue := node.SplitValue()
+
+	var left, right []*Node
+
+	forkJoin(tokens,
+		func() {
+			if !kv.IsSome || nodeKeyValue > kv.Value {
+				left = t.parallelPartialSearchQuery(key, node.Left, depth+1, tokens)
+			}
+		},
+		func() {
+			if !kv.IsSome || nodeKeyValue <= kv.Value {
+				right = t.parallelPartialSearchQuery(key, node.Right, depth+1, tokens)
+			}
+		})
+
+	// same order as partialSearchQuery
+	nodes := make([]*Node, 0, len(left)+len(right)+1)
+	if node.Key.IsPartiallyEqual(key) {
+		nodes = append(nodes, node)
+	}
+
+	return append(append(nodes, left...), right...)
+}
+
+// runs first in a new goroutine if a token is free and
+// second in the current one, then waits for both
+func forkJoin(tokens chan struct{}, first func(), second func()) {
+
+	var wg sync.WaitGroup
+
+	select {
+	case tokens <- struct{}{}:
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			first()
+			<-tokens
+		}()
+	default:
+		first()
+	}
+
+	second()
+	wg.Wait()
+}
+
+// computes the distance to every node, which in high dimensions is
+// often faster than a search whose pruning barely skips any subtree.
+// The subtrees below the fork depth are shared among the workers.
+func (t *KDTree) bruteForceKNN(key *Point, k int, options *NNOptions) []Value {
+
+	heaps := make([]*neighbourHeap, t.workers)
+	for i := range heaps {
+		heaps[i] = newNeighbourHeap(k)
+	}
+
+	// the nodes above the fork depth are handled here
+	level := []*Node{t.root}
+	for depth := 0; depth < t.forkDepth() && len(level) > 0; depth++ {
+		var next []*Node
+		for _, n := range level {
+			if options.accepts(&n.Key, n.GetValue()) {
+				_, distance := key.GetSquaredDistance(&n.Key)
+				heaps[0].offer(n.GetValue(), distance)
+			}
+			for _, child := range []*Node{n.Left, n.Right} {
+				if child != nil {
+					next = append(next, child)
+				}
+			}
+		}
+		level = next
+	}
+	subtrees := level
+
+	var wg sync.WaitGroup
+	for w := 0; w < t.workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			stack := make([]*Node, 0, 64)
+			for i := w; i < len(subtrees); i += t.workers {
+				stack = append(stack, subtrees[i])
+				for len(stack) > 0 {
+					n := stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+
+					if options.accepts(&n.Key, n.GetValue()) {
+						_, distance := key.GetSquaredDistance(&n.Key)
+						heaps[w].offer(n.GetValue(), distance)
+					}
+
+					if n.Left != nil {
+						stack = append(stack, n.Left)
+					}
+					if n.Right != nil {
+						stack = append(stack, n.Right)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	result := heaps[0]
+	for _, h := range heaps[1:] {
+		for _, n := range h.items {
+			result.offer(n.value, n.distance)
+		}
+	}
+
+	return result.sorted()
+}
+
+// returns the k nearest neighbours of every key like GetKNN, results[i]
+// belongs to keys[i]. The queries run on one goroutine per core.
+func (t *KDTree) GetNNBatch(keys []*Point, k int) ([][]Value, error) {
+
+	return t.GetNNBatchWithOptions(keys, k, nil)
+}
+
+func (t *KDTree) GetNNBatchWithOptions(keys []*Point, k int, options *NNOptions) ([][]Value, error) {
+
+	if t.root == nil {
+		return nil, errors.New("Tree is empty!")
+	}
+
+	if k < 1 {
+		return nil, errors.New("k has to be at least 1")
+	}
+
+	if options == nil {
+		options = &NNOptions{}
+	}
+
+	if err := options.check(t.kSize); err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		if key == nil || key.GetSize() != t.kSize || key.IsEmpty() {
+			return nil, fmt.Errorf("Wrong or nil key at index %d!", i)
+		}
+	}
+
+	// no query returns more values than there are keys
+	if k > t.root.count {
+		k = t.root.count
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(keys) {
+		workers = len(keys)
+	}
+
+	// all results share one backing array
+	results := make([][]Value, len(keys))
+	values := make([]Value, 0, len(keys)*k)
+	for i := range results {
+		results[i] = values[i*k : i*k : (i+1)*k]
+	}
+
+	var next int64 = -1
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// one search and heap per worker, reset for every query
+			search := &nnSearch{options: *options, neighbours: newNeighbourHeap(k)}
+
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(keys) {
+					return
+				}
+
+				if options.BruteForce {
+					results[i] = append(results[i], t.bruteForceKNN(keys[i], k, options)...)
+					continue
+				}
+
+				search.key = keys[i]
+				search.visits = 0
+				search.neighbours.reset(k)
+
+				t.nearestNeighbour(search, t.root)
+				results[i] = search.neighbours.appendSorted(results[i])
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return results, nil
+}
@@ -21,32 +21,10 @@ func NewPoint(c Key) Point {
 	return Point{coords: c}
 }
 
-func (p *Point) IsWithin(from *Point, to *Point) bool {
-
-	var fromCoord uint64 = 0
-	var toCoord uint64 = math.MaxUint64
+func (p *Point) IsWithin(r *Range) bool {
 
 	for i, nk := range p.coords {
-
-		if from != nil {
-			_, fromK := from.GetKeyAt(i)
-			if fromK.IsSome {
-				fromCoord = fromK.Value
-			} else {
-				fromCoord = 0
-			}
-		}
-
-		if to != nil {
-			_, toK := to.GetKeyAt(i)
-			if toK.IsSome {
-				toCoord = toK.Value
-			} else {
-				toCoord = math.MaxUint64
-			}
-		}
-
-		if nk.Value > toCoord || nk.Value < fromCoord {
+		if !r.containsAt(i, nk.Value) {
 			return false
 		}
 	}
@@ -103,6 +81,18 @@ func (p *Point) IsPartial() bool {
 	return false
 }
 
+// reports whether all coordinates are None
+func (p *Point) IsEmpty() bool {
+
+	for _, k := range p.coords {
+		if k.IsSome {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (p *Point) GetByteSize() uint64 {
 	return uint64(len(p.coords))*12 + 10
 }
@@ -121,6 +111,16 @@ func (p *Point) GetKeyAt(i int) (error, OptionalUInt64) {
 
 func (p *Point) GetDistance(p_1 *Point) (error, float64) {
 
+	err, squared := p.GetSquaredDistance(p_1)
+
+	return err, math.Sqrt(squared)
+}
+
+// squared euclidean distance, which orders points like the distance
+// but needs no square root. Coordinates which are None in either point
+// are skipped.
+func (p *Point) GetSquaredDistance(p_1 *Point) (error, float64) {
+
 	if p.GetSize() != p_1.GetSize() {
 		return errors.New("Points have different sizes"), 0.0
 	}
@@ -131,22 +131,41 @@ func (p *Point) GetDistance(p_1 *Point) (error, float64) {
 		_, p1k := p_1.GetKeyAt(i)
 
 		if p1k.IsSome && k.IsSome {
+			deltaSum += squaredDelta(k.Value, p1k.Value)
+		}
+	}
+
+	return nil, deltaSum
+}
 
-			// avoid overflow
-			var tmp uint64
-			if k.Value > p1k.Value {
-				tmp = k.Value - p1k.Value
-			} else {
-				tmp = p1k.Value - k.Value
-			}
+// squared distance to a key given as plain coordinates, computed like
+// GetSquaredDistance. coords must have the same size as the point.
+func (p *Point) GetSquaredDistanceTo(coords []uint64) float64 {
 
-			deltaSum += float64(tmp * tmp)
+	deltaSum := 0.0
 
+	for i, k := range p.coords {
+		if k.IsSome {
+			deltaSum += squaredDelta(k.Value, coords[i])
 		}
+	}
+
+	return deltaSum
+}
+
+// the difference is exact in uint64, but its square may need
+// 128 bits and is therefore computed in float64
+func squaredDelta(a uint64, b uint64) float64 {
 
+	var delta uint64
+	if a > b {
+		delta = a - b
+	} else {
+		delta = b - a
 	}
 
-	return nil, math.Sqrt(deltaSum)
+	d := float64(delta)
+	return d * d
 }
 
 // size is 12 bytes
@@ -0,0 +1,127 @@
+/**
+pqueue.go
+Priority queues used by the nearest neighbour searches
+*/
+
+package main
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// candidate of a nearest neighbour search
+type neighbour struct {
+	value    Value
+	distance float64 // squared, which orders like the distance
+}
+
+// keeps the k closest neighbours seen so far. It is a max-heap,
+// so that the farthest neighbour can be replaced in O(log k).
+type neighbourHeap struct {
+	k     int
+	items []neighbour
+}
+
+// initial capacity of a heap at most, k may exceed the number of keys
+const maxNeighbourCapacity = 1024
+
+func newNeighbourHeap(k int) *neighbourHeap {
+	capacity := k
+	if capacity > maxNeighbourCapacity {
+		capacity = maxNeighbourCapacity
+	}
+	return &neighbourHeap{k: k, items: make([]neighbour, 0, capacity)}
+}
+
+func (h *neighbourHeap) Len() int           { return len(h.items) }
+func (h *neighbourHeap) Less(i, j int) bool { return h.items[i].distance > h.items[j].distance }
+func (h *neighbourHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *neighbourHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(neighbour))
+}
+
+func (h *neighbourHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// adds the value if it is closer than the
+// farthest neighbour or the heap is not full
+func (h *neighbourHeap) offer(value Value, distance float64) {
+	if !h.isFull() {
+		heap.Push(h, neighbour{value: value, distance: distance})
+	} else if distance < h.items[0].distance {
+		h.items[0] = neighbour{value: value, distance: distance}
+		heap.Fix(h, 0)
+	}
+}
+
+func (h *neighbourHeap) isFull() bool {
+	return len(h.items) >= h.k
+}
+
+// squared distance a value needs to beat to be added, infinite until
+// the heap is full, so that no scaled distance exceeds it before
+func (h *neighbourHeap) bound() float64 {
+	if !h.isFull() {
+		return math.Inf(1)
+	}
+	return h.items[0].distance
+}
+
+// returns the values ordered by ascending distance
+func (h *neighbourHeap) sorted() []Value {
+	items := append([]neighbour(nil), h.items...)
+	sort.SliceStable(items, func(i, j int) bool { return items[i].distance < items[j].distance })
+
+	values := make([]Value, len(items))
+	for i, n := range items {
+		values[i] = n.value
+	}
+	return values
+}
+
+// appends the values ordered by ascending distance without copying
+// the heap, which has to be reset before it is used again
+func (h *neighbourHeap) appendSorted(values []Value) []Value {
+	sort.SliceStable(h.items, func(i, j int) bool { return h.items[i].distance < h.items[j].distance })
+
+	for _, n := range h.items {
+		values = append(values, n.value)
+	}
+	return values
+}
+
+// clears the heap but keeps its allocation
+func (h *neighbourHeap) reset(k int) {
+	h.k = k
+	h.items = h.items[:0]
+}
+
+// subtree of a forest which is still to search
+type branch struct {
+	node     *forestNode
+	distance float64 // lower bound of the squared distance to any point in node
+}
+
+// min-heap of branches ordered by their distance bound
+type branchQueue []branch
+
+func (q branchQueue) Len() int           { return len(q) }
+func (q branchQueue) Less(i, j int) bool { return q[i].distance < q[j].distance }
+func (q branchQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *branchQueue) Push(x interface{}) {
+	*q = append(*q, x.(branch))
+}
+
+func (q *branchQueue) Pop() interface{} {
+	old := *q
+	last := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return last
+}
@@ -0,0 +1,533 @@
+/*
+*
+reference_store_test.go
+Brute-force reference store and randomized tests comparing it to the KDTree
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// ReferenceStore implements KVStore with a linear scan over all
+// entries. Entries are kept in insertion order and exact key
+// operations act on the oldest entry stored under a key, which
+// is the one the KDTree finds first on its search path.
+type ReferenceStore struct {
+	kSize   int
+	entries []KeyValuePair
+}
+
+var _ KVStore = (*ReferenceStore)(nil)
+var _ KVStore = (*KDTree)(nil)
+
+func NewReferenceStore(keySize int) *ReferenceStore {
+	return &ReferenceStore{kSize: keySize}
+}
+
+func (r *ReferenceStore) Put(key *Point, value Value) error {
+	if key.GetSize() != r.kSize || key.IsPartial() {
+		return errors.New("wrong key")
+	}
+
+	r.entries = append(r.entries, KeyValuePair{key: *key, value: value})
+	return nil
+}
+
+func (r *ReferenceStore) Get(key *Point) ([]Value, error) {
+	values := make([]Value, 0)
+
+	if key.IsPartial() {
+		for _, e := range r.entries {
+			if e.key.IsPartiallyEqual(key) {
+				values = append(values, e.value)
+			}
+		}
+		return values, nil
+	}
+
+	index := r.indexOf(key)
+	if index < 0 {
+		return values, errors.New("key not found")
+	}
+
+	return append(values, r.entries[index].value), nil
+}
+
+func (r *ReferenceStore) Delete(key *Point) error {
+	index := r.indexOf(key)
+	if index < 0 {
+		return errors.New("key not found")
+	}
+
+	r.entries = append(r.entries[:index], r.entries[index+1:]...)
+	return nil
+}
+
+func (r *ReferenceStore) Scan(from *Point, to *Point) ([]Value, error) {
+	bounds, err := NewRange(r.kSize, from, to)
+	if err != nil {
+		return make([]Value, 0), err
+	}
+
+	return r.ScanRange(bounds)
+}
+
+func (r *ReferenceStore) ScanRange(bounds *Range) ([]Value, error) {
+	values := make([]Value, 0)
+
+	for _, e := range r.entries {
+		if e.key.IsWithin(bounds) {
+			values = append(values, e.value)
+		}
+	}
+
+	return values, nil
+}
+
+func (r *ReferenceStore) GetNN(key *Point) (Value, error) {
+	if len(r.entries) == 0 {
+		return *new(Value), errors.New("store is empty")
+	}
+
+	if key.GetSize() != r.kSize || key.IsEmpty() {
+		return *new(Value), errors.New("wrong key")
+	}
+
+	// None coordinates are ignored by the distance
+	nearest := 0
+	_, min := key.GetDistance(&r.entries[0].key)
+
+	for i, e := range r.entries {
+		if _, distance := key.GetDistance(&e.key); distance < min {
+			min = distance
+			nearest = i
+		}
+	}
+
+	return r.entries[nearest].value, nil
+}
+
+func (r *ReferenceStore) Upsert(key *Point, value Value) error {
+	if key.GetSize() != r.kSize || key.IsPartial() {
+		return errors.New("wrong key")
+	}
+
+	index := r.indexOf(key)
+	if index < 0 {
+		return errors.New("key not found")
+	}
+
+	r.entries[index].value = value
+	return nil
+}
+
+// the entries form a list, each one its own node at depth 1
+func (r *ReferenceStore) Stats() *TreeStats {
+	c := newStatsCollector()
+	for i := range r.entries {
+		c.addPoint(&r.entries[i].key, 1)
+	}
+	return c.finish()
+}
+
+func (r *ReferenceStore) indexOf(key *Point) int {
+	for i, e := range r.entries {
+		if e.key.IsEqual(key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// returns the key stored with value, values are unique in these tests
+func (r *ReferenceStore) keyOf(value Value) (*Point, bool) {
+	for _, e := range r.entries {
+		if e.value == value {
+			return &e.key, true
+		}
+	}
+	return nil, false
+}
+
+type operationKind int
+
+const (
+	opPut operationKind = iota
+	opDelete
+	opUpsert
+	opGet
+	opScan
+	opGetNN
+	opCount
+)
+
+var operationNames = []string{"Put", "Delete", "Upsert", "Get", "Scan", "GetNN"}
+
+type operation struct {
+	kind  operationKind
+	key   Key
+	to    Key // upper bound of a Scan
+	value Value
+}
+
+func (o operation) String() string {
+	switch o.kind {
+	case opScan:
+		return fmt.Sprintf("Scan(%s, %s)", formatKey(o.key), formatKey(o.to))
+	case opPut, opUpsert:
+		return fmt.Sprintf("%s(%s, %d)", operationNames[o.kind], formatKey(o.key), binary.BigEndian.Uint64(o.value[:8]))
+	default:
+		return fmt.Sprintf("%s(%s)", operationNames[o.kind], formatKey(o.key))
+	}
+}
+
+func formatKey(k Key) string {
+	coords := make([]string, len(k))
+	for i, c := range k {
+		if c.IsSome {
+			coords[i] = fmt.Sprint(c.Value)
+		} else {
+			coords[i] = "_"
+		}
+	}
+	return "[" + strings.Join(coords, " ") + "]"
+}
+
+func formatOperations(ops []operation) string {
+	lines := make([]string, len(ops))
+	for i, o := range ops {
+		lines[i] = fmt.Sprintf("\t%d: %s", i, o)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// decodes a byte string into a sequence of operations. Coordinates
+// are kept small so that duplicate keys and ties are common.
+func decodeOperations(data []byte, dimensions int) []operation {
+	ops := make([]operation, 0)
+	next := func() byte {
+		if len(data) == 0 {
+			return 0
+		}
+		b := data[0]
+		data = data[1:]
+		return b
+	}
+	key := func(partial bool) Key {
+		k := make(Key, dimensions)
+		for d := range k {
+			b := next()
+			if partial && b >= 0xc0 {
+				k[d] = None()
+			} else {
+				k[d] = UInt64(uint64(b % 8))
+			}
+		}
+		return k
+	}
+
+	for len(data) > 0 {
+		o := operation{kind: operationKind(next() % byte(opCount))}
+
+		switch o.kind {
+		case opGet, opScan, opGetNN:
+			o.key = key(true)
+		default:
+			o.key = key(false)
+		}
+
+		if o.kind == opScan {
+			o.to = key(true)
+		}
+
+		// every written value is unique
+		binary.BigEndian.PutUint64(o.value[:8], uint64(len(ops)))
+
+		ops = append(ops, o)
+	}
+
+	return ops
+}
+
+func randomOperations(r *rand.Rand, dimensions int, count int) []operation {
+	data := make([]byte, count*(1+2*dimensions))
+	r.Read(data)
+	return decodeOperations(data, dimensions)
+}
+
+// store checked against the reference
+type validatedStore interface {
+	KVStore
+	Validate() error
+}
+
+type storeFactory struct {
+	name string
+	new  func(dimensions int) (validatedStore, error)
+}
+
+var storeFactories = []storeFactory{
+	kdTreeFactory(RoundRobin),
+	kdTreeFactory(MaxSpread),
+	kdTreeFactory(MaxVariance),
+	bucketTreeFactory(1),
+	bucketTreeFactory(4),
+	{
+		name: "KDTree with 4 workers",
+		new: func(dimensions int) (validatedStore, error) {
+			tree, err := NewKDTree(dimensions, STORESIZE)
+			if err == nil {
+				err = tree.SetWorkers(4)
+			}
+			return tree, err
+		},
+	},
+	{
+		name: "ArenaKDTree",
+		new: func(dimensions int) (validatedStore, error) {
+			return NewArenaKDTree(dimensions)
+		},
+	},
+}
+
+func kdTreeFactory(strategy SplitStrategy) storeFactory {
+	return storeFactory{
+		name: fmt.Sprintf("KDTree with strategy %d", strategy),
+		new: func(dimensions int) (validatedStore, error) {
+			return NewKDTreeWithStrategy(dimensions, STORESIZE, strategy)
+		},
+	}
+}
+
+func bucketTreeFactory(bucketSize int) storeFactory {
+	return storeFactory{
+		name: fmt.Sprintf("BucketKDTree with bucket size %d", bucketSize),
+		new: func(dimensions int) (validatedStore, error) {
+			return NewBucketKDTree(dimensions, bucketSize)
+		},
+	}
+}
+
+// runs ops against a new store and the reference store
+// and returns an error describing the first divergence
+func runOperations(dimensions int, factory storeFactory, ops []operation) (err error) {
+	tree, err := factory.new(dimensions)
+	if err != nil {
+		return err
+	}
+	reference := NewReferenceStore(dimensions)
+
+	current := 0
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("operation %d %s: panic: %v", current, ops[current], r)
+		}
+	}()
+
+	for i, o := range ops {
+		current = i
+		key := NewPoint(o.key)
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("operation %d %s: %s", i, o, fmt.Sprintf(format, args...))
+		}
+
+		switch o.kind {
+		case opPut:
+			err, expected := tree.Put(&key, o.value), reference.Put(&key, o.value)
+			if (err == nil) != (expected == nil) {
+				return fail("error %v, expected %v", err, expected)
+			}
+		case opDelete:
+			err, expected := tree.Delete(&key), reference.Delete(&key)
+			if (err == nil) != (expected == nil) {
+				return fail("error %v, expected %v", err, expected)
+			}
+		case opUpsert:
+			err, expected := tree.Upsert(&key, o.value), reference.Upsert(&key, o.value)
+			if (err == nil) != (expected == nil) {
+				return fail("error %v, expected %v", err, expected)
+			}
+		case opGet:
+			values, err := tree.Get(&key)
+			expected, expectedErr := reference.Get(&key)
+			if (err == nil) != (expectedErr == nil) {
+				return fail("error %v, expected %v", err, expectedErr)
+			}
+			if !sameValues(values, expected) {
+				return fail("got %d values, expected %d", len(values), len(expected))
+			}
+		case opScan:
+			to := NewPoint(o.to)
+			values, err := tree.Scan(&key, &to)
+			expected, expectedErr := reference.Scan(&key, &to)
+			if (err == nil) != (expectedErr == nil) {
+				return fail("error %v, expected %v", err, expectedErr)
+			}
+			if !sameValues(values, expected) {
+				return fail("got %d values, expected %d", len(values), len(expected))
+			}
+			if ranged, ok := tree.(interface {
+				ScanRange(r *Range) ([]Value, error)
+			}); ok && err == nil {
+				// the same bounds, the bits of the unused
+				// value choose which of them are exclusive
+				bounds, _ := NewRange(dimensions, &key, &to)
+				for d := 0; d < dimensions; d++ {
+					bounds.minExclusive[d] = o.value[7]>>(d%4)&1 == 1
+					bounds.maxExclusive[d] = o.value[7]>>(d%4+4)&1 == 1
+				}
+				values, err := ranged.ScanRange(bounds)
+				expected, _ := reference.ScanRange(bounds)
+				if err != nil || !sameValues(values, expected) {
+					return fail("got %d values with exclusive bounds and error %v, expected %d", len(values), err, len(expected))
+				}
+			}
+			if counter, ok := tree.(interface {
+				Count(from *Point, to *Point) (int, error)
+			}); ok && err == nil {
+				if count, err := counter.Count(&key, &to); err != nil || count != len(expected) {
+					return fail("counted %d with error %v, expected %d", count, err, len(expected))
+				}
+			}
+		case opGetNN:
+			value, err := tree.GetNN(&key)
+			expected, expectedErr := reference.GetNN(&key)
+			if (err == nil) != (expectedErr == nil) {
+				return fail("error %v, expected %v", err, expectedErr)
+			}
+			if err != nil {
+				break
+			}
+			// ties may resolve to different values,
+			// so the distances are compared instead
+			found, ok := reference.keyOf(value)
+			if !ok {
+				return fail("returned a value which is not stored")
+			}
+			expectedKey, _ := reference.keyOf(expected)
+			_, distance := key.GetDistance(found)
+			_, expectedDistance := key.GetDistance(expectedKey)
+			if distance != expectedDistance {
+				return fail("distance %f, expected %f", distance, expectedDistance)
+			}
+		}
+
+		if err := tree.Validate(); err != nil {
+			return fail("%v", err)
+		}
+
+		stats, expected := tree.Stats(), reference.Stats()
+		if stats.Count != expected.Count || stats.Duplicates != expected.Duplicates ||
+			!reflect.DeepEqual(stats.Min, expected.Min) || !reflect.DeepEqual(stats.Max, expected.Max) {
+			return fail("stats %+v, expected %+v", stats, expected)
+		}
+	}
+
+	return nil
+}
+
+// compares values as multisets
+func sameValues(values []Value, expected []Value) bool {
+	if len(values) != len(expected) {
+		return false
+	}
+
+	sorted := func(v []Value) []Value {
+		s := append([]Value(nil), v...)
+		sort.Slice(s, func(i, j int) bool { return bytes.Compare(s[i][:], s[j][:]) < 0 })
+		return s
+	}
+
+	a, b := sorted(values), sorted(expected)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// removes operations as long as the sequence keeps failing
+func shrinkOperations(dimensions int, factory storeFactory, ops []operation) []operation {
+	for changed := true; changed; {
+		changed = false
+		for i := len(ops) - 1; i >= 0; i-- {
+			candidate := append(append([]operation(nil), ops[:i]...), ops[i+1:]...)
+			if runOperations(dimensions, factory, candidate) != nil {
+				ops = candidate
+				changed = true
+			}
+		}
+	}
+	return ops
+}
+
+func checkOperations(t *testing.T, dimensions int, factory storeFactory, ops []operation) {
+	if err := runOperations(dimensions, factory, ops); err != nil {
+		minimal := shrinkOperations(dimensions, factory, ops)
+		t.Fatalf("%v\nminimal failing sequence in %dD on %s:\n%s",
+			runOperations(dimensions, factory, minimal), dimensions, factory.name, formatOperations(minimal))
+	}
+}
+
+func TestRandomOperationsAgainstReference(t *testing.T) {
+	r := rand.New(rand.NewSource(28))
+
+	for run := 0; run < 200; run++ {
+		dimensions := 1 + r.Intn(4)
+		factory := storeFactories[run%len(storeFactories)]
+		checkOperations(t, dimensions, factory, randomOperations(r, dimensions, 200))
+	}
+}
+
+func TestReferenceStoreGetNN(t *testing.T) {
+	reference := NewReferenceStore(3)
+
+	toSearch, toFind, toStore := createValues(3, 50)
+
+	for _, kv := range toStore {
+		assert.NoError(t, reference.Put(&kv.key, kv.value))
+	}
+
+	if result, err := reference.GetNN(&toSearch.key); assert.NoError(t, err) {
+		assert.Equal(t, toFind.value, result)
+	}
+
+	_, err := NewReferenceStore(3).GetNN(&toSearch.key)
+	assert.Error(t, err)
+}
+
+// run with go test -fuzz FuzzKDTree, the fuzzer
+// minimizes failing inputs on its own
+func FuzzKDTree(f *testing.F) {
+	f.Add(uint8(0), []byte{0, 1, 3, 1, 5, 1, 4, 0})
+	f.Add(uint8(1), []byte{0, 1, 2, 0, 1, 2, 0, 2, 1, 1, 1, 2, 3, 0xff, 0xff, 5, 3, 3})
+	f.Add(uint8(2), []byte{0, 7, 7, 7, 0, 7, 7, 7, 1, 7, 7, 7, 2, 7, 7, 7, 4, 0, 0, 0, 7, 7, 7})
+	f.Add(uint8(3), make([]byte, 64))
+
+	f.Fuzz(func(t *testing.T, d uint8, data []byte) {
+		dimensions := 1 + int(d%4)
+		factory := storeFactories[int(d/4)%len(storeFactories)]
+		checkOperations(t, dimensions, factory, decodeOperations(data, dimensions))
+	})
+}
+
+func TestDecodeOperations(t *testing.T) {
+	ops := decodeOperations([]byte{0, 1, 2, 4, 0xff, 3, 9, 0xc0}, 2)
+
+	if assert.Len(t, ops, 2) {
+		assert.Equal(t, "Put([1 2], 0)", ops[0].String())
+		assert.Equal(t, "Scan([_ 3], [1 _])", ops[1].String())
+	}
+}
@@ -0,0 +1,250 @@
+/**
+region.go
+Queries for keys within arbitrary regions
+*/
+
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// Region is a set of keys a ScanRegion returns. The tree only descends
+// into subtrees whose bounding box the region intersects, so Intersects
+// may report true for a box the region does not intersect, which only
+// costs time, but never false for one it does.
+// The box passed to Intersects must not be modified.
+type Region interface {
+	Contains(p *Point) bool
+	Intersects(box *BoundingBox) bool
+}
+
+// implemented by regions which only fit trees of some key size,
+// ScanRegion returns the error of check instead of scanning
+type checkedRegion interface {
+	check(kSize int) error
+}
+
+// returns the values of all keys within region
+func (t *KDTree) ScanRegion(region Region) ([]Value, error) {
+
+	if region == nil {
+		return make([]Value, 0), errors.New("region is nil")
+	}
+
+	if r, ok := region.(checkedRegion); ok {
+		if err := r.check(t.kSize); err != nil {
+			return make([]Value, 0), err
+		}
+	}
+
+	return nodeValues(t.regionQuery(t.root, region, make([]*Node, 0, 10))), nil
+}
+
+func (t *KDTree) regionQuery(node *Node, region Region, nodes []*Node) []*Node {
+
+	if node == nil || !region.Intersects(&node.box) {
+		return nodes
+	}
+
+	nodes = t.regionQuery(node.Left, region, nodes)
+	nodes = t.regionQuery(node.Right, region, nodes)
+
+	if region.Contains(&node.Key) {
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+func (b *BoundingBox) check(kSize int) error {
+	if len(b.Min) != kSize || len(b.Max) != kSize {
+		return errors.New("wrong box size")
+	}
+	return nil
+}
+
+func (b *BoundingBox) Contains(p *Point) bool {
+	for i, k := range p.coords {
+		if k.Value < b.Min[i] || k.Value > b.Max[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *BoundingBox) Intersects(box *BoundingBox) bool {
+	for i := range b.Min {
+		if b.Max[i] < box.Min[i] || b.Min[i] > box.Max[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Ball holds the keys within Radius of Center, which has one
+// coordinate per dimension of the tree
+type Ball struct {
+	Center []float64
+	Radius float64
+}
+
+func (b *Ball) check(kSize int) error {
+	if len(b.Center) != kSize {
+		return errors.New("wrong center size")
+	}
+	return nil
+}
+
+func (b *Ball) Contains(p *Point) bool {
+	sum := 0.0
+	for i, k := range p.coords {
+		d := float64(k.Value) - b.Center[i]
+		sum += d * d
+	}
+	return sum <= b.Radius*b.Radius
+}
+
+// compares the distance of the closest point of box to the center
+func (b *Ball) Intersects(box *BoundingBox) bool {
+	sum := 0.0
+	for i, c := range b.Center {
+		d := 0.0
+		if min := float64(box.Min[i]); c < min {
+			d = min - c
+		} else if max := float64(box.Max[i]); c > max {
+			d = c - max
+		}
+		sum += d * d
+	}
+	return sum <= b.Radius*b.Radius
+}
+
+// HalfSpace holds the keys p with Normal · p <= Offset,
+// Normal has one coordinate per dimension of the tree
+type HalfSpace struct {
+	Normal []float64
+	Offset float64
+}
+
+func (h *HalfSpace) check(kSize int) error {
+	if len(h.Normal) != kSize {
+		return errors.New("wrong normal size")
+	}
+	return nil
+}
+
+func (h *HalfSpace) Contains(p *Point) bool {
+	sum := 0.0
+	for i, k := range p.coords {
+		sum += h.Normal[i] * float64(k.Value)
+	}
+	return sum <= h.Offset
+}
+
+// compares the corner of box with the smallest product
+func (h *HalfSpace) Intersects(box *BoundingBox) bool {
+	sum := 0.0
+	for i, n := range h.Normal {
+		if n >= 0 {
+			sum += n * float64(box.Min[i])
+		} else {
+			sum += n * float64(box.Max[i])
+		}
+	}
+	return sum <= h.Offset
+}
+
+// Polygon2D holds the keys whose coordinates at X and Y lie within the
+// polygon, all other coordinates are not restricted. The polygon is
+// closed from the last vertex back to the first one and may be concave,
+// self intersections are resolved by the even-odd rule. Keys exactly on
+// an edge may or may not be contained.
+type Polygon2D struct {
+	X        int
+	Y        int
+	Vertices [][2]float64
+}
+
+func (g *Polygon2D) check(kSize int) error {
+	if g.X < 0 || g.X >= kSize || g.Y < 0 || g.Y >= kSize {
+		return errors.New("X and Y have to be dimensions of the tree")
+	}
+	return nil
+}
+
+func (g *Polygon2D) Contains(p *Point) bool {
+	return g.containsXY(float64(p.coords[g.X].Value), float64(p.coords[g.Y].Value))
+}
+
+// casts a ray towards positive x and counts the crossed edges
+func (g *Polygon2D) containsXY(x float64, y float64) bool {
+	inside := false
+	for i, j := 0, len(g.Vertices)-1; i < len(g.Vertices); j, i = i, i+1 {
+		a, b := g.Vertices[i], g.Vertices[j]
+		if (a[1] > y) != (b[1] > y) && x < (b[0]-a[0])*(y-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// the polygon and the rectangle of box intersect if a vertex lies in the
+// rectangle, a corner in the polygon or if their edges cross
+func (g *Polygon2D) Intersects(box *BoundingBox) bool {
+
+	if len(g.Vertices) == 0 {
+		return false
+	}
+
+	minX, maxX := float64(box.Min[g.X]), float64(box.Max[g.X])
+	minY, maxY := float64(box.Min[g.Y]), float64(box.Max[g.Y])
+
+	for _, v := range g.Vertices {
+		if v[0] >= minX && v[0] <= maxX && v[1] >= minY && v[1] <= maxY {
+			return true
+		}
+	}
+
+	corners := [4][2]float64{{minX, minY}, {maxX, minY}, {maxX, maxY}, {minX, maxY}}
+
+	for _, c := range corners {
+		if g.containsXY(c[0], c[1]) {
+			return true
+		}
+	}
+
+	for i, j := 0, len(g.Vertices)-1; i < len(g.Vertices); j, i = i, i+1 {
+		for k := range corners {
+			if segmentsCross(g.Vertices[j], g.Vertices[i], corners[k], corners[(k+1)%4]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// reports whether the segments ab and cd intersect, touching included
+func segmentsCross(a, b, c, d [2]float64) bool {
+
+	orientation := func(p, q, r [2]float64) float64 {
+		return (q[0]-p[0])*(r[1]-p[1]) - (q[1]-p[1])*(r[0]-p[0])
+	}
+
+	onSegment := func(p, q, r [2]float64) bool {
+		return math.Min(p[0], q[0]) <= r[0] && r[0] <= math.Max(p[0], q[0]) &&
+			math.Min(p[1], q[1]) <= r[1] && r[1] <= math.Max(p[1], q[1])
+	}
+
+	d1, d2 := orientation(c, d, a), orientation(c, d, b)
+	d3, d4 := orientation(a, b, c), orientation(a, b, d)
+
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+
+	return (d1 == 0 && onSegment(c, d, a)) || (d2 == 0 && onSegment(c, d, b)) ||
+		(d3 == 0 && onSegment(a, b, c)) || (d4 == 0 && onSegment(a, b, d))
+}
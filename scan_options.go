@@ -0,0 +1,459 @@
+/**
+scan_options.go
+Ordered and paged range queries
+*/
+
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+type ScanOrder int
+
+const (
+	// ascending by the coordinate at Dimension, ties are broken
+	// by the whole key compared coordinate by coordinate
+	OrderByDimension ScanOrder = iota
+
+	// ascending by the distance to Point, ties are broken like above
+	OrderByDistance
+)
+
+// ScanOptions order and page the result of a Scan. Equal keys are
+// ordered by their values, so the order is total up to entries with
+// equal key and value, which are indistinguishable anyway.
+type ScanOptions struct {
+	Order      ScanOrder
+	Dimension  int    // OrderByDimension
+	Point      *Point // OrderByDistance
+	Descending bool
+
+	Offset int // entries to skip
+	Limit  int // maximal number of entries, 0 means no limit
+
+	// continuation token of the previous page, the page starts after
+	// the last entry of the previous one. Entries put or deleted in
+	// between do not shift the pages, unless they are put before the
+	// end of the previous page. All other options have to be the same
+	// as for the previous page, except for Offset and Limit.
+	After string
+}
+
+type ScanPage struct {
+	Keys   []Point
+	Values []Value
+
+	// continuation token, empty on the last page
+	Next string
+}
+
+// entry of an ordered scan
+type scanEntry struct {
+	key      *Point
+	value    Value
+	distance float64 // squared, OrderByDistance
+}
+
+// returns the entries a Scan with the same bounds would return,
+// ordered and paged according to options. With a Limit only the entries
+// up to the end of the page are kept, and subtrees which cannot hold
+// any of them or only entries of previous pages are skipped.
+func (t *KDTree) ScanWithOptions(from *Point, to *Point, options *ScanOptions) (*ScanPage, error) {
+
+	r, err := NewRange(t.kSize, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if options == nil {
+		options = &ScanOptions{}
+	}
+
+	if err := t.checkScanOptions(options); err != nil {
+		return nil, err
+	}
+
+	var cursor *scanEntry
+	returned := 0
+
+	if options.After != "" {
+		key, count, err := t.decodeScanToken(options)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := options.newEntry(key, Value{})
+		cursor, returned = &entry, count
+
+		options.narrowToCursor(r, key)
+	}
+
+	// the entries up to the end of the page and one more, to know
+	// whether there is a next page, all of them without a Limit
+	selection := &scanSelection{
+		options: options,
+		r:       r,
+		cursor:  cursor,
+		kept:    &scanHeap{options: options},
+	}
+
+	if options.Limit > 0 {
+		selection.size = returned + 1
+		for _, n := range []int{options.Offset, options.Limit} {
+			if selection.size > math.MaxInt-n {
+				selection.size = 0
+				break
+			}
+			selection.size += n
+		}
+	}
+
+	selection.visit(t.root)
+
+	entries := selection.kept.entries
+	sort.Slice(entries, func(i, j int) bool {
+		return options.compare(&entries[i], &entries[j]) < 0
+	})
+
+	start := 0
+	for start < returned && start < len(entries) && options.compareKeys(&entries[start], cursor) == 0 {
+		start++
+	}
+
+	if options.Offset < len(entries)-start {
+		start += options.Offset
+	} else {
+		start = len(entries)
+	}
+
+	end := len(entries)
+	if options.Limit > 0 && options.Limit < end-start {
+		end = start + options.Limit
+	}
+
+	page := &ScanPage{
+		Keys:   make([]Point, 0, end-start),
+		Values: make([]Value, 0, end-start),
+	}
+
+	for _, e := range entries[start:end] {
+		page.Keys = append(page.Keys, NewPoint(append(Key(nil), e.key.coords...)))
+		page.Values = append(page.Values, e.value)
+	}
+
+	if end < len(entries) {
+		// the token counts all entries with the last key up to the
+		// last one, including those returned by previous pages
+		last := end - 1
+		first := last
+		for first > 0 && options.compareKeys(&entries[first-1], &entries[last]) == 0 {
+			first--
+		}
+
+		page.Next = options.encodeScanToken(entries[last].key, last-first+1)
+	}
+
+	return page, nil
+}
+
+// state of an ordered scan, which keeps the first entries in the
+// order of the options and skips subtrees which cannot hold any
+type scanSelection struct {
+	options *ScanOptions
+	r       *Range
+	cursor  *scanEntry // nil on the first page
+	size    int        // entries to keep, 0 keeps all
+	kept    *scanHeap
+}
+
+func (s *scanSelection) visit(node *Node) {
+
+	if node == nil || !node.box.intersectsRange(s.r) || s.prunes(&node.box) {
+		return
+	}
+
+	if node.Key.IsWithin(s.r) {
+		s.offer(node)
+	}
+
+	visitLeft, visitRight := scanBranches(node, s.r)
+
+	left, right := node.Left, node.Right
+	if !visitLeft {
+		left = nil
+	}
+	if !visitRight {
+		right = nil
+	}
+
+	// the subtree which may hold earlier entries first,
+	// so that the kept entries prune the other one
+	if left != nil && right != nil && s.precedes(&right.box, &left.box) {
+		left, right = right, left
+	}
+
+	s.visit(left)
+	s.visit(right)
+}
+
+// entries before the cursor belong to previous pages,
+// the ones with the key of the cursor may not
+func (s *scanSelection) offer(node *Node) {
+
+	entry := s.options.newEntry(&node.Key, node.value)
+	if s.cursor != nil && s.options.compareKeys(&entry, s.cursor) < 0 {
+		return
+	}
+
+	if s.size == 0 || s.kept.Len() < s.size {
+		heap.Push(s.kept, entry)
+	} else if s.options.compare(&entry, &s.kept.entries[0]) < 0 {
+		s.kept.entries[0] = entry
+		heap.Fix(s.kept, 0)
+	}
+}
+
+// reports whether no key within box can be ordered after the cursor,
+// or, once enough entries are kept, before the last of them
+func (s *scanSelection) prunes(box *BoundingBox) bool {
+
+	o := s.options
+
+	if o.Order == OrderByDistance {
+		min, max := box.minSquaredDistance(o.Point), box.maxSquaredDistance(o.Point)
+		if o.Descending {
+			min, max = -max, -min
+		}
+
+		// ordered by the distance ties are broken by the
+		// key, so keys at equal distance cannot be pruned
+		if s.cursor != nil && max < s.cursorDistance() {
+			return true
+		}
+
+		return s.isFull() && min > s.lastDistance()
+	}
+
+	// the range is narrowed to the cursor already
+	if !s.isFull() {
+		return false
+	}
+
+	last := s.kept.entries[0].key.coords[o.Dimension].Value
+	if o.Descending {
+		return box.Max[o.Dimension] < last
+	}
+	return box.Min[o.Dimension] > last
+}
+
+func (s *scanSelection) isFull() bool {
+	return s.size > 0 && s.kept.Len() >= s.size
+}
+
+// distances of the cursor and the last kept entry,
+// negated when descending like in prunes
+func (s *scanSelection) cursorDistance() float64 {
+	if s.options.Descending {
+		return -s.cursor.distance
+	}
+	return s.cursor.distance
+}
+
+func (s *scanSelection) lastDistance() float64 {
+	if s.options.Descending {
+		return -s.kept.entries[0].distance
+	}
+	return s.kept.entries[0].distance
+}
+
+// reports whether box a may hold entries ordered before those of box b
+func (s *scanSelection) precedes(a *BoundingBox, b *BoundingBox) bool {
+
+	o := s.options
+
+	if o.Order == OrderByDistance {
+		if o.Descending {
+			return a.maxSquaredDistance(o.Point) > b.maxSquaredDistance(o.Point)
+		}
+		return a.minSquaredDistance(o.Point) < b.minSquaredDistance(o.Point)
+	}
+
+	if o.Descending {
+		return a.Max[o.Dimension] > b.Max[o.Dimension]
+	}
+	return a.Min[o.Dimension] < b.Min[o.Dimension]
+}
+
+// max-heap of the entries kept by an ordered scan, the one ordered last on top
+type scanHeap struct {
+	options *ScanOptions
+	entries []scanEntry
+}
+
+func (h *scanHeap) Len() int           { return len(h.entries) }
+func (h *scanHeap) Less(i, j int) bool { return h.options.compare(&h.entries[i], &h.entries[j]) > 0 }
+func (h *scanHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+
+func (h *scanHeap) Push(x interface{}) {
+	h.entries = append(h.entries, x.(scanEntry))
+}
+
+func (h *scanHeap) Pop() interface{} {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
+
+func (t *KDTree) checkScanOptions(options *ScanOptions) error {
+
+	switch options.Order {
+	case OrderByDimension:
+		if options.Dimension < 0 || options.Dimension >= t.kSize {
+			return errors.New("Dimension out of range")
+		}
+	case OrderByDistance:
+		if options.Point == nil || options.Point.GetSize() != t.kSize || options.Point.IsPartial() {
+			return errors.New("Wrong or nil Point!")
+		}
+	default:
+		return errors.New("unknown scan order")
+	}
+
+	if options.Offset < 0 || options.Limit < 0 {
+		return errors.New("Offset and Limit cannot be negative")
+	}
+
+	return nil
+}
+
+func (o *ScanOptions) newEntry(key *Point, value Value) scanEntry {
+
+	entry := scanEntry{key: key, value: value}
+
+	if o.Order == OrderByDistance {
+		_, entry.distance = o.Point.GetSquaredDistance(key)
+	}
+
+	return entry
+}
+
+// compares the positions of the keys of a and b, negative if a comes
+// first, 0 if the keys are equal
+func (o *ScanOptions) compareKeys(a *scanEntry, b *scanEntry) int {
+
+	result := 0
+
+	if o.Order == OrderByDistance {
+		if a.distance < b.distance {
+			result = -1
+		} else if a.distance > b.distance {
+			result = 1
+		}
+	} else {
+		result = compareUInt64(a.key.coords[o.Dimension].Value, b.key.coords[o.Dimension].Value)
+	}
+
+	for i := 0; result == 0 && i < len(a.key.coords); i++ {
+		result = compareUInt64(a.key.coords[i].Value, b.key.coords[i].Value)
+	}
+
+	if o.Descending {
+		return -result
+	}
+	return result
+}
+
+// like compareKeys, but equal keys are compared by their values
+func (o *ScanOptions) compare(a *scanEntry, b *scanEntry) int {
+
+	if result := o.compareKeys(a, b); result != 0 {
+		return result
+	}
+
+	if o.Descending {
+		return bytes.Compare(b.value[:], a.value[:])
+	}
+	return bytes.Compare(a.value[:], b.value[:])
+}
+
+func compareUInt64(a uint64, b uint64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// ordered by a dimension, no entry after the cursor can have a lower
+// (or when descending greater) coordinate there, so the range shrinks
+func (o *ScanOptions) narrowToCursor(r *Range, cursor *Point) {
+
+	if o.Order != OrderByDimension {
+		return
+	}
+
+	bound := cursor.coords[o.Dimension].Value
+
+	if o.Descending {
+		if max := r.maxKey.coords[o.Dimension]; !max.IsSome || bound < max.Value {
+			r.SetUpper(o.Dimension, bound, false)
+		}
+		return
+	}
+
+	if min := r.minKey.coords[o.Dimension]; !min.IsSome || bound > min.Value {
+		r.SetLower(o.Dimension, bound, false)
+	}
+}
+
+// a token holds order, direction and dimension to detect tokens of other
+// options, then the number of returned entries with the last key and the key
+const scanTokenHeader = 1 + 1 + 4 + 4
+
+func (o *ScanOptions) encodeScanToken(key *Point, count int) string {
+
+	buffer := make([]byte, scanTokenHeader+8*len(key.coords))
+
+	buffer[0] = byte(o.Order)
+	if o.Descending {
+		buffer[1] = 1
+	}
+	binary.BigEndian.PutUint32(buffer[2:], uint32(o.Dimension))
+	binary.BigEndian.PutUint32(buffer[6:], uint32(count))
+
+	for i, k := range key.coords {
+		binary.BigEndian.PutUint64(buffer[scanTokenHeader+8*i:], k.Value)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buffer)
+}
+
+func (t *KDTree) decodeScanToken(options *ScanOptions) (*Point, int, error) {
+
+	buffer, err := base64.RawURLEncoding.DecodeString(options.After)
+	if err != nil || len(buffer) != scanTokenHeader+8*t.kSize {
+		return nil, 0, errors.New("invalid continuation token")
+	}
+
+	descending := buffer[1] == 1
+	if ScanOrder(buffer[0]) != options.Order || descending != options.Descending ||
+		(options.Order == OrderByDimension && int(binary.BigEndian.Uint32(buffer[2:])) != options.Dimension) {
+		return nil, 0, errors.New("continuation token belongs to other scan options")
+	}
+
+	key := make(Key, t.kSize)
+	for i := range key {
+		key[i] = UInt64(binary.BigEndian.Uint64(buffer[scanTokenHeader+8*i:]))
+	}
+	p := NewPoint(key)
+
+	return &p, int(binary.BigEndian.Uint32(buffer[6:])), nil
+}
@@ -0,0 +1,175 @@
+/**
+split.go
+Selection of the split axis of new nodes
+*/
+
+package main
+
+// SplitStrategy decides on which axis a new node splits its subtree.
+// The axis is stored in the node, so all queries follow it regardless
+// of the strategy and a tree may even mix strategies.
+type SplitStrategy int
+
+const (
+	// splits on depth % kSize like a textbook k-d tree
+	RoundRobin SplitStrategy = iota
+
+	// splits on the axis along which the cell of the new node, clipped
+	// to the bounding box of all keys put so far, is the widest
+	MaxSpread
+
+	// splits on the axis with the highest estimated variance within the
+	// cell of the new node. The variance of all keys put so far is scaled
+	// by the squared share of the axis the cell covers, which assumes
+	// locally uniform keys.
+	MaxVariance
+)
+
+// region of the key space covered by a node,
+// given by the splits of its ancestors
+type cell struct {
+	lower   []uint64 // inclusive
+	upper   []uint64 // exclusive, if bounded
+	bounded []bool
+}
+
+func newCell(kSize int) *cell {
+	return &cell{
+		lower:   make([]uint64, kSize),
+		upper:   make([]uint64, kSize),
+		bounded: make([]bool, kSize),
+	}
+}
+
+func (c *cell) clone() *cell {
+	return &cell{
+		lower:   append([]uint64(nil), c.lower...),
+		upper:   append([]uint64(nil), c.upper...),
+		bounded: append([]bool(nil), c.bounded...),
+	}
+}
+
+// restricts the cell to the left side of a split,
+// does nothing on a nil cell
+func (c *cell) toLeft(axis int, split uint64) {
+	if c != nil && (!c.bounded[axis] || split < c.upper[axis]) {
+		c.upper[axis] = split
+		c.bounded[axis] = true
+	}
+}
+
+// restricts the cell to the right side of a split,
+// does nothing on a nil cell
+func (c *cell) toRight(axis int, split uint64) {
+	if c != nil && split > c.lower[axis] {
+		c.lower[axis] = split
+	}
+}
+
+func (c *cell) contains(p *Point) bool {
+	for i, k := range p.coords {
+		if k.Value < c.lower[i] || (c.bounded[i] && k.Value >= c.upper[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// running statistics over all keys ever put, they are
+// not updated on delete and therefore only estimates
+type keyStatistics struct {
+	count      int
+	min        []uint64
+	max        []uint64
+	sum        []float64
+	sumSquares []float64
+}
+
+func newKeyStatistics(kSize int) keyStatistics {
+	return keyStatistics{
+		min:        make([]uint64, kSize),
+		max:        make([]uint64, kSize),
+		sum:        make([]float64, kSize),
+		sumSquares: make([]float64, kSize),
+	}
+}
+
+func (s *keyStatistics) add(p *Point) {
+	for i, k := range p.coords {
+		if s.count == 0 || k.Value < s.min[i] {
+			s.min[i] = k.Value
+		}
+		if s.count == 0 || k.Value > s.max[i] {
+			s.max[i] = k.Value
+		}
+
+		v := float64(k.Value)
+		s.sum[i] += v
+		s.sumSquares[i] += v * v
+	}
+	s.count++
+}
+
+func (s *keyStatistics) variance(axis int) float64 {
+	if s.count == 0 {
+		return 0
+	}
+
+	n := float64(s.count)
+	mean := s.sum[axis] / n
+	return s.sumSquares[axis]/n - mean*mean
+}
+
+// returns the split axis for a new node at depth covering c
+func (t *KDTree) chooseAxis(depth int, c *cell) int {
+
+	if t.strategy == RoundRobin || c == nil {
+		return depth % t.kSize
+	}
+
+	// ties resolve round robin, which matters
+	// as long as only few keys are stored
+	best := depth % t.kSize
+	bestScore := -1.0
+
+	for i := 0; i < t.kSize; i++ {
+		axis := (depth + i) % t.kSize
+		if score := t.axisScore(axis, c); score > bestScore {
+			best = axis
+			bestScore = score
+		}
+	}
+
+	return best
+}
+
+func (t *KDTree) axisScore(axis int, c *cell) float64 {
+
+	lower := t.stats.min[axis]
+	if c.lower[axis] > lower {
+		lower = c.lower[axis]
+	}
+
+	upper := t.stats.max[axis]
+	if c.bounded[axis] {
+		if c.upper[axis] == 0 {
+			return 0
+		}
+		if c.upper[axis]-1 < upper {
+			upper = c.upper[axis] - 1
+		}
+	}
+
+	if upper <= lower {
+		return 0
+	}
+
+	width := float64(upper - lower)
+
+	if t.strategy == MaxSpread {
+		return width
+	}
+
+	share := width / float64(t.stats.max[axis]-t.stats.min[axis])
+	return t.stats.variance(axis) * share * share
+}
@@ -0,0 +1,261 @@
+/**
+stats.go
+Statistics over the shape and the keys of a store
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// TreeStats describes a store at the time Stats was called. For an empty
+// store the counts, depths and Min and Max are zero or nil, the size
+// fields still hold what the store accounts for. Stats walks all keys
+// and keeps a copy of each to count duplicates, so it takes O(n * kSize)
+// time and memory.
+type TreeStats struct {
+	Count int // stored keys
+	Nodes int // nodes of the tree, inner nodes and leaves
+
+	// bytes used as accounted for by the store and its limit,
+	// both 0 if the store does not account for its size
+	ByteSize uint64
+	MaxSize  uint64
+
+	// depth of the nodes holding keys, the root has depth 1
+	MaxDepth     int
+	AverageDepth float64
+
+	// MaxDepth divided by the smallest depth a binary tree with as many
+	// nodes can have, 1 for a perfectly balanced tree
+	Balance float64
+
+	// smallest and greatest coordinate per dimension
+	Min []uint64
+	Max []uint64
+
+	// keys equal to a key stored before
+	Duplicates int
+}
+
+// collects the stats key by key
+type statsCollector struct {
+	stats    *TreeStats
+	depthSum int
+	keys     map[string]bool
+	buffer   []byte
+}
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{stats: &TreeStats{}, keys: make(map[string]bool)}
+}
+
+// adds a key held by a node at depth
+func (c *statsCollector) add(key []uint64, depth int) {
+
+	s := c.stats
+
+	if s.Count == 0 {
+		s.Min = append([]uint64(nil), key...)
+		s.Max = append([]uint64(nil), key...)
+	}
+
+	for i, v := range key {
+		if v < s.Min[i] {
+			s.Min[i] = v
+		}
+		if v > s.Max[i] {
+			s.Max[i] = v
+		}
+	}
+
+	if len(c.buffer) != 8*len(key) {
+		c.buffer = make([]byte, 8*len(key))
+	}
+	for i, v := range key {
+		binary.BigEndian.PutUint64(c.buffer[8*i:], v)
+	}
+
+	if c.keys[string(c.buffer)] {
+		s.Duplicates++
+	} else {
+		c.keys[string(c.buffer)] = true
+	}
+
+	s.Count++
+	c.depthSum += depth
+
+	if depth > s.MaxDepth {
+		s.MaxDepth = depth
+	}
+}
+
+// adds a key given as a point
+func (c *statsCollector) addPoint(key *Point, depth int) {
+
+	coords := make([]uint64, len(key.coords))
+	for i, k := range key.coords {
+		coords[i] = k.Value
+	}
+
+	c.add(coords, depth)
+}
+
+func (c *statsCollector) finish() *TreeStats {
+
+	s := c.stats
+
+	if s.Count > 0 {
+		s.AverageDepth = float64(c.depthSum) / float64(s.Count)
+	}
+
+	if s.Nodes > 0 {
+		s.Balance = float64(s.MaxDepth) / math.Ceil(math.Log2(float64(s.Nodes+1)))
+	}
+
+	return s
+}
+
+func (t *KDTree) Stats() *TreeStats {
+
+	c := newStatsCollector()
+	c.stats.ByteSize, c.stats.MaxSize = t.size, t.maxSize
+
+	type frame struct {
+		node  *Node
+		depth int
+	}
+
+	stack := []frame{{node: t.root, depth: 1}}
+
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if f.node == nil {
+			continue
+		}
+
+		c.stats.Nodes++
+		c.addPoint(&f.node.Key, f.depth)
+
+		// the left subtree first, so that duplicates count like on a Get
+		stack = append(stack, frame{node: f.node.Right, depth: f.depth + 1}, frame{node: f.node.Left, depth: f.depth + 1})
+	}
+
+	return c.finish()
+}
+
+// counts a node at depth, its parent is counted already
+func (t *KDTree) addDepth(depth int) {
+	if depth == len(t.depths) {
+		t.depths = append(t.depths, 0)
+	}
+	t.depths[depth]++
+}
+
+// uncounts a node at depth, empty depths at the bottom are dropped
+func (t *KDTree) removeDepth(depth int) {
+	t.depths[depth]--
+
+	for len(t.depths) > 0 && t.depths[len(t.depths)-1] == 0 {
+		t.depths = t.depths[:len(t.depths)-1]
+	}
+}
+
+// counts all nodes of the subtree of node at depth
+func (t *KDTree) countDepths(node *Node, depth int) {
+	if node == nil {
+		return
+	}
+
+	t.addDepth(depth)
+	t.countDepths(node.Left, depth+1)
+	t.countDepths(node.Right, depth+1)
+}
+
+// the gauges without walking the tree, the nodes per depth are kept
+// up to date by puts and deletes
+func (t *KDTree) gauges() storeGauges {
+
+	g := storeGauges{keys: t.root.GetCount(), byteSize: t.size, maxSize: t.maxSize}
+	g.nodes = g.keys
+	g.maxDepth = len(t.depths)
+
+	depthSum := 0
+	for d, n := range t.depths {
+		depthSum += (d + 1) * n
+	}
+	if g.nodes > 0 {
+		g.averageDepth = float64(depthSum) / float64(g.nodes)
+	}
+
+	return g
+}
+
+func (t *ArenaKDTree) Stats() *TreeStats {
+
+	c := newStatsCollector()
+
+	type frame struct {
+		node  int32
+		depth int
+	}
+
+	stack := []frame{{node: t.root, depth: 1}}
+
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if f.node == noNode {
+			continue
+		}
+
+		c.stats.Nodes++
+		c.add(t.keyAt(f.node), f.depth)
+
+		n := &t.nodes[f.node]
+		stack = append(stack, frame{node: n.right, depth: f.depth + 1}, frame{node: n.left, depth: f.depth + 1})
+	}
+
+	return c.finish()
+}
+
+// the keys of a leaf have the depth of the leaf
+func (t *BucketKDTree) Stats() *TreeStats {
+
+	c := newStatsCollector()
+
+	// an empty tree is a single empty leaf
+	if t.count == 0 {
+		return c.finish()
+	}
+
+	type frame struct {
+		node  *bucketNode
+		depth int
+	}
+
+	stack := []frame{{node: t.root, depth: 1}}
+
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		c.stats.Nodes++
+
+		if f.node.isLeaf() {
+			for i := range f.node.values {
+				c.add(f.node.coords[i*t.kSize:(i+1)*t.kSize], f.depth)
+			}
+			continue
+		}
+
+		stack = append(stack, frame{node: f.node.right, depth: f.depth + 1}, frame{node: f.node.left, depth: f.depth + 1})
+	}
+
+	return c.finish()
+}
@@ -0,0 +1,117 @@
+/**
+trace.go
+Tracing the work done by single queries
+*/
+
+package main
+
+import (
+	"errors"
+)
+
+// QueryTrace counts the work of a single query
+type QueryTrace struct {
+	VisitedNodes   int // nodes whose key was looked at
+	PrunedBranches int // subtrees skipped without looking at their root
+	Distances      int // distances computed between the query and a key
+	MaxDepth       int // depth of the deepest visited node, the root has depth 1
+}
+
+// all methods do nothing on a nil trace,
+// so untraced queries only pay for the check
+
+func (q *QueryTrace) visit(depth int) {
+	if q == nil {
+		return
+	}
+
+	q.VisitedNodes++
+	if depth > q.MaxDepth {
+		q.MaxDepth = depth
+	}
+}
+
+// counts the skipped subtree node, unless there is none
+func (q *QueryTrace) prune(node *Node) {
+	if q != nil && node != nil {
+		q.PrunedBranches++
+	}
+}
+
+func (q *QueryTrace) computeDistance() {
+	if q != nil {
+		q.Distances++
+	}
+}
+
+// like Get, but also returns the work it took.
+// Traced queries always run on a single goroutine.
+func (t *KDTree) GetTraced(key *Point) ([]Value, *QueryTrace, error) {
+
+	trace := &QueryTrace{}
+
+	if key.IsPartial() {
+		return nodeValues(t.partialSearchQuery(key, t.root, 1, trace)), trace, nil
+	}
+
+	_, node := t.searchQuery(key, trace)
+	if node == nil {
+		return make([]Value, 0, 0), trace, errors.New("Couldn't find key")
+	}
+
+	return []Value{node.GetValue()}, trace, nil
+}
+
+// like Scan, but also returns the work it took. Nodes of subtrees
+// within the range count as visited although their keys are not compared.
+func (t *KDTree) ScanTraced(from *Point, to *Point) ([]Value, *QueryTrace, error) {
+
+	trace := &QueryTrace{}
+
+	r, err := NewRange(t.kSize, from, to)
+	if err != nil {
+		return make([]Value, 0), trace, err
+	}
+
+	return nodeValues(t.scanQuery(t.root, r, 1, trace)), trace, nil
+}
+
+// like GetNNWithOptions, but also returns the work it took.
+// Brute force searches cannot be traced.
+func (t *KDTree) GetNNTraced(key *Point, options *NNOptions) (Value, *QueryTrace, error) {
+
+	trace := &QueryTrace{}
+
+	if t.root == nil {
+		return *new(Value), trace, errors.New("Tree is empty!")
+	}
+
+	if key == nil || key.GetSize() != t.kSize {
+		return *new(Value), trace, errors.New("Wrong or nil key!")
+	}
+
+	if key.IsEmpty() {
+		return *new(Value), trace, errors.New("key has no coordinates")
+	}
+
+	if options == nil {
+		options = &NNOptions{}
+	}
+
+	if err := options.check(t.kSize); err != nil {
+		return *new(Value), trace, err
+	}
+
+	if options.BruteForce {
+		return *new(Value), trace, errors.New("BruteForce cannot be traced")
+	}
+
+	search := &nnSearch{key: key, options: *options, neighbours: newNeighbourHeap(1), trace: trace}
+	t.nearestNeighbour(search, t.root)
+
+	if search.neighbours.Len() == 0 {
+		return *new(Value), trace, errors.New("no key passes the filter")
+	}
+
+	return search.neighbours.items[0].value, trace, nil
+}